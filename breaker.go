@@ -0,0 +1,167 @@
+package dspider
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	BREAKER_CLOSED    = 0
+	BREAKER_OPEN      = 1
+	BREAKER_HALF_OPEN = 2
+
+	DEFAULT_BREAKER_OPEN_TIMEOUT = 30 * time.Second
+)
+
+var breakerStateNames = []string{"closed", "open", "half-open"}
+
+// Breaker configures the per-host circuit breakers. A host's breaker opens when at least
+// FailureRatio of its last Window's crawls failed, once there were MinRequests of them. Its
+// requests then wait in the frontier for OpenTimeout, after which up to HalfOpenProbes requests
+// are crawled. If they all succeed the breaker closes, otherwise it opens again. A zero Window
+// counts all crawls since the breaker closed, and a zero OpenTimeout defaults to
+// DEFAULT_BREAKER_OPEN_TIMEOUT.
+type Breaker struct {
+	FailureRatio   float64
+	MinRequests    int
+	Window         time.Duration
+	OpenTimeout    time.Duration
+	HalfOpenProbes int
+}
+
+func (b Breaker) openTimeout() time.Duration {
+	if b.OpenTimeout > 0 {
+		return b.OpenTimeout
+	}
+	return DEFAULT_BREAKER_OPEN_TIMEOUT
+}
+
+func (b Breaker) probes() int {
+	if b.HalfOpenProbes > 0 {
+		return b.HalfOpenProbes
+	}
+	return 1
+}
+
+type hostBreaker struct {
+	state int
+	// generation counts the state changes, so results of requests allowed in an earlier state
+	// are ignored.
+	generation  uint64
+	windowStart time.Time
+	requests    int
+	failures    int
+	openUntil   time.Time
+	// Probes crawling and succeeded while half-open.
+	probing   int
+	succeeded int
+}
+
+type breakerManager struct {
+	mu    sync.Mutex
+	b     Breaker
+	hosts map[string]*hostBreaker
+}
+
+func newBreakerManager(b Breaker) *breakerManager {
+	return &breakerManager{b: b, hosts: make(map[string]*hostBreaker)}
+}
+
+// breakerToken is handed out by allow for each allowed request, and given back to done.
+type breakerToken struct {
+	generation uint64
+	probe      bool
+}
+
+func (m *breakerManager) get(host string, now time.Time) *hostBreaker {
+	hb := m.hosts[host]
+	if hb == nil {
+		hb = &hostBreaker{windowStart: now}
+		m.hosts[host] = hb
+	}
+	return hb
+}
+
+func (m *breakerManager) setState(host string, hb *hostBreaker, state int, now time.Time) {
+	glog.Warningf("Circuit breaker of %s is %s.", host, breakerStateNames[state])
+	hb.state = state
+	hb.generation++
+	hb.probing, hb.succeeded = 0, 0
+	hb.requests, hb.failures, hb.windowStart = 0, 0, now
+	if state == BREAKER_OPEN {
+		hb.openUntil = now.Add(m.b.openTimeout())
+	}
+}
+
+// allow returns whether a request to host can be crawled now, and if not when to try again.
+// Every allowed request must be followed by a call to done with the returned token.
+func (m *breakerManager) allow(host string, now time.Time) (breakerToken, bool, time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hb := m.get(host, now)
+	if hb.state == BREAKER_OPEN {
+		if now.Before(hb.openUntil) {
+			return breakerToken{}, false, hb.openUntil
+		}
+		m.setState(host, hb, BREAKER_HALF_OPEN, now)
+	}
+	t := breakerToken{generation: hb.generation}
+	if hb.state == BREAKER_HALF_OPEN {
+		if hb.probing+hb.succeeded >= m.b.probes() {
+			return breakerToken{}, false, now.Add(m.b.openTimeout())
+		}
+		hb.probing++
+		t.probe = true
+	}
+	return t, true, time.Time{}
+}
+
+func (m *breakerManager) done(host string, t breakerToken, err error, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hb := m.get(host, now)
+	if t.generation != hb.generation {
+		return
+	}
+	cancelled := errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+	switch {
+	case t.probe:
+		hb.probing--
+		if cancelled {
+			return
+		} else if err != nil {
+			m.setState(host, hb, BREAKER_OPEN, now)
+		} else if hb.succeeded++; hb.succeeded >= m.b.probes() {
+			m.setState(host, hb, BREAKER_CLOSED, now)
+		}
+	case hb.state == BREAKER_CLOSED:
+		if cancelled {
+			return
+		}
+		if m.b.Window > 0 && now.Sub(hb.windowStart) > m.b.Window {
+			hb.requests, hb.failures, hb.windowStart = 0, 0, now
+		}
+		hb.requests++
+		if err != nil {
+			hb.failures++
+		}
+		if hb.requests >= m.b.MinRequests &&
+			float64(hb.failures) >= m.b.FailureRatio*float64(hb.requests) && hb.failures > 0 {
+			m.setState(host, hb, BREAKER_OPEN, now)
+		}
+	}
+}
+
+func (m *breakerManager) states() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	states := make(map[string]int, len(m.hosts))
+	for host, hb := range m.hosts {
+		states[host] = hb.state
+	}
+	return states
+}
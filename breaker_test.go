@@ -0,0 +1,136 @@
+package dspider
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// breakerStep asks to allow a request at the given time, or if done finishes the request of
+// the req'th allow step with err.
+type breakerStep struct {
+	at          time.Duration
+	done        bool
+	req         int
+	err         error
+	wantAllowed bool
+	wantState   int
+}
+
+func allowAt(at time.Duration, wantAllowed bool, wantState int) breakerStep {
+	return breakerStep{at: at, wantAllowed: wantAllowed, wantState: wantState}
+}
+
+func doneAt(at time.Duration, req int, err error, wantState int) breakerStep {
+	return breakerStep{at: at, done: true, req: req, err: err, wantState: wantState}
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	failed := errors.New("failed")
+	timeout := DEFAULT_BREAKER_OPEN_TIMEOUT
+	tests := []struct {
+		name  string
+		b     Breaker
+		steps []breakerStep
+	}{
+		{"opens after MinRequests", Breaker{FailureRatio: 0.5, MinRequests: 2}, []breakerStep{
+			allowAt(0, true, BREAKER_CLOSED),
+			allowAt(0, true, BREAKER_CLOSED),
+			doneAt(0, 0, failed, BREAKER_CLOSED),
+			doneAt(0, 1, failed, BREAKER_OPEN),
+			allowAt(time.Second, false, BREAKER_OPEN),
+		}},
+		{"stays closed below FailureRatio", Breaker{FailureRatio: 0.6, MinRequests: 2},
+			[]breakerStep{
+				allowAt(0, true, BREAKER_CLOSED),
+				allowAt(0, true, BREAKER_CLOSED),
+				allowAt(0, true, BREAKER_CLOSED),
+				doneAt(0, 0, failed, BREAKER_CLOSED),
+				doneAt(0, 1, nil, BREAKER_CLOSED),
+				doneAt(0, 2, nil, BREAKER_CLOSED),
+			}},
+		{"ignores cancelled crawls", Breaker{FailureRatio: 0.5, MinRequests: 1}, []breakerStep{
+			allowAt(0, true, BREAKER_CLOSED),
+			doneAt(0, 0, context.Canceled, BREAKER_CLOSED),
+		}},
+		{"restarts the Window", Breaker{FailureRatio: 1, MinRequests: 2, Window: time.Second},
+			[]breakerStep{
+				allowAt(0, true, BREAKER_CLOSED),
+				doneAt(0, 0, failed, BREAKER_CLOSED),
+				allowAt(2*time.Second, true, BREAKER_CLOSED),
+				doneAt(2*time.Second, 1, failed, BREAKER_CLOSED),
+			}},
+		{"closes after the probes succeed", Breaker{FailureRatio: 1, MinRequests: 1,
+			HalfOpenProbes: 2}, []breakerStep{
+			allowAt(0, true, BREAKER_CLOSED),
+			doneAt(0, 0, failed, BREAKER_OPEN),
+			allowAt(timeout-time.Second, false, BREAKER_OPEN),
+			allowAt(timeout, true, BREAKER_HALF_OPEN),
+			allowAt(timeout, true, BREAKER_HALF_OPEN),
+			allowAt(timeout, false, BREAKER_HALF_OPEN),
+			doneAt(timeout, 2, nil, BREAKER_HALF_OPEN),
+			allowAt(timeout, false, BREAKER_HALF_OPEN),
+			doneAt(timeout, 3, nil, BREAKER_CLOSED),
+			allowAt(timeout, true, BREAKER_CLOSED),
+		}},
+		{"reopens after a probe fails", Breaker{FailureRatio: 1, MinRequests: 1},
+			[]breakerStep{
+				allowAt(0, true, BREAKER_CLOSED),
+				doneAt(0, 0, failed, BREAKER_OPEN),
+				allowAt(timeout, true, BREAKER_HALF_OPEN),
+				doneAt(timeout, 1, failed, BREAKER_OPEN),
+				allowAt(timeout+time.Second, false, BREAKER_OPEN),
+				allowAt(2*timeout, true, BREAKER_HALF_OPEN),
+			}},
+		{"a cancelled probe frees its slot", Breaker{FailureRatio: 1, MinRequests: 1},
+			[]breakerStep{
+				allowAt(0, true, BREAKER_CLOSED),
+				doneAt(0, 0, failed, BREAKER_OPEN),
+				allowAt(timeout, true, BREAKER_HALF_OPEN),
+				doneAt(timeout, 1, context.Canceled, BREAKER_HALF_OPEN),
+				allowAt(timeout, true, BREAKER_HALF_OPEN),
+			}},
+		{"ignores stale failures", Breaker{FailureRatio: 1, MinRequests: 1}, []breakerStep{
+			allowAt(0, true, BREAKER_CLOSED),
+			allowAt(0, true, BREAKER_CLOSED),
+			doneAt(0, 0, failed, BREAKER_OPEN),
+			allowAt(timeout, true, BREAKER_HALF_OPEN),
+			doneAt(timeout, 1, failed, BREAKER_HALF_OPEN),
+			allowAt(timeout, false, BREAKER_HALF_OPEN),
+			doneAt(timeout, 2, nil, BREAKER_CLOSED),
+		}},
+		{"ignores stale successes", Breaker{FailureRatio: 1, MinRequests: 1}, []breakerStep{
+			allowAt(0, true, BREAKER_CLOSED),
+			allowAt(0, true, BREAKER_CLOSED),
+			doneAt(0, 0, failed, BREAKER_OPEN),
+			allowAt(timeout, true, BREAKER_HALF_OPEN),
+			doneAt(timeout, 1, nil, BREAKER_HALF_OPEN),
+			allowAt(timeout, false, BREAKER_HALF_OPEN),
+			doneAt(timeout, 2, failed, BREAKER_OPEN),
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newBreakerManager(test.b)
+			start := time.Now()
+			var tokens []breakerToken
+			for i, step := range test.steps {
+				now := start.Add(step.at)
+				if step.done {
+					m.done("host", tokens[step.req], step.err, now)
+				} else {
+					token, allowed, _ := m.allow("host", now)
+					if allowed != step.wantAllowed {
+						t.Errorf("step %d: allowed is %v, want %v", i, allowed, step.wantAllowed)
+					}
+					tokens = append(tokens, token)
+				}
+				if state := m.states()["host"]; state != step.wantState {
+					t.Errorf("step %d: state is %s, want %s", i, breakerStateNames[state],
+						breakerStateNames[step.wantState])
+				}
+			}
+		})
+	}
+}
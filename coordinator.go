@@ -0,0 +1,291 @@
+package dspider
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	COORDINATOR_PATH_PUSH      = "/push"
+	COORDINATOR_PATH_LEASE     = "/lease"
+	COORDINATOR_PATH_DONE      = "/done"
+	COORDINATOR_PATH_REQUEUE   = "/requeue"
+	COORDINATOR_PATH_LEN       = "/len"
+	COORDINATOR_PATH_HEARTBEAT = "/heartbeat"
+
+	COORDINATOR_PARAM_WORKER = "worker"
+)
+
+type pushReply struct {
+	Queued bool
+}
+
+type lenReply struct {
+	Len int
+}
+
+type lease struct {
+	req      *Request
+	shard    int
+	worker   string
+	deadline time.Time
+}
+
+type shardOwner struct {
+	worker  string
+	expires time.Time
+}
+
+// Coordinator owns the frontier of a distributed crawl and leases requests to workers, which
+// run SimpleSpiders with a RemoteFrontier. Requests are sharded by host, and a shard is only
+// leased to one worker at a time, so each worker's politeness limits still hold. A shard or
+// lease whose worker misses heartbeats for the lease timeout is handed to another worker.
+// Shards don't move while their worker is alive, and a worker only takes its share of them, so
+// there should be more shards than workers.
+type Coordinator struct {
+	mu           sync.Mutex
+	shards       []Frontier
+	owners       []shardOwner
+	workers      map[string]time.Time
+	expired      [][]*Request
+	leases       map[string]*lease
+	leaseTimeout time.Duration
+	next         int
+	mux          *http.ServeMux
+}
+
+func NewCoordinator(shards []Frontier, leaseTimeout time.Duration) *Coordinator {
+	c := &Coordinator{
+		shards:       shards,
+		owners:       make([]shardOwner, len(shards)),
+		workers:      make(map[string]time.Time),
+		expired:      make([][]*Request, len(shards)),
+		leases:       make(map[string]*lease),
+		leaseTimeout: leaseTimeout,
+		mux:          http.NewServeMux(),
+	}
+	c.mux.HandleFunc(COORDINATOR_PATH_PUSH, c.handlePush)
+	c.mux.HandleFunc(COORDINATOR_PATH_LEASE, c.handleLease)
+	c.mux.HandleFunc(COORDINATOR_PATH_DONE, c.handleDone)
+	c.mux.HandleFunc(COORDINATOR_PATH_REQUEUE, c.handleRequeue)
+	c.mux.HandleFunc(COORDINATOR_PATH_LEN, c.handleLen)
+	c.mux.HandleFunc(COORDINATOR_PATH_HEARTBEAT, c.handleHeartbeat)
+	return c
+}
+
+func (c *Coordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mux.ServeHTTP(w, r)
+}
+
+func (c *Coordinator) shardOf(req *Request) int {
+	h := fnv.New32a()
+	h.Write([]byte(hostOf(req.URL)))
+	return int(h.Sum32() % uint32(len(c.shards)))
+}
+
+func (c *Coordinator) Push(req *Request) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.shards[c.shardOf(req)].Push(req)
+}
+
+// Lease returns the next request for the worker, from a shard it owns or, if it owns less than
+// its share, a free one.
+func (c *Coordinator) Lease(worker string) (*Request, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.expireLeases(now)
+	c.renew(worker, now)
+	owned := 0
+	for shard := range c.owners {
+		if c.owned(shard, worker, now) {
+			owned++
+		}
+	}
+	live := 0
+	for w, expires := range c.workers {
+		if now.Before(expires) {
+			live++
+		} else {
+			delete(c.workers, w)
+		}
+	}
+	share := (len(c.shards) + live - 1) / live
+	for i := 0; i < 2*len(c.shards); i++ {
+		shard := (c.next + i) % len(c.shards)
+		// Try the worker's own shards first.
+		if i < len(c.shards) {
+			if !c.owned(shard, worker, now) {
+				continue
+			}
+		} else if owned >= share || !c.free(shard, now) {
+			continue
+		}
+		var req *Request
+		if expired := c.expired[shard]; len(expired) > 0 {
+			req = expired[0]
+			c.expired[shard] = expired[1:]
+		} else if popped, ok := c.shards[shard].Pop(); ok {
+			req = popped
+		} else {
+			continue
+		}
+		c.next = shard + 1
+		c.owners[shard] = shardOwner{worker: worker, expires: now.Add(c.leaseTimeout)}
+		c.leases[req.Key()] = &lease{
+			req:      req,
+			shard:    shard,
+			worker:   worker,
+			deadline: now.Add(c.leaseTimeout),
+		}
+		return req, true
+	}
+	return nil, false
+}
+
+func (c *Coordinator) Done(worker string, req *Request) {
+	c.release(worker, req, func(shard Frontier) { shard.MarkDone(req) })
+}
+
+// Requeue ends the lease of a request whose crawl failed, and puts it back in its shard to be
+// retried after req.NotBefore.
+func (c *Coordinator) Requeue(worker string, req *Request) {
+	c.release(worker, req, func(shard Frontier) { shard.Requeue(req) })
+}
+
+func (c *Coordinator) release(worker string, req *Request, f func(shard Frontier)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := req.Key()
+	l := c.leases[key]
+	if l == nil || l.worker != worker {
+		// e.g. a late release of a lease that expired and went to another worker.
+		glog.V(1).Infof("'%s' released by %s, but it isn't leased to it.", key, worker)
+		return
+	}
+	delete(c.leases, key)
+	f(c.shards[l.shard])
+	c.renew(worker, time.Now())
+	if c.drained(l.shard) {
+		c.owners[l.shard] = shardOwner{}
+	}
+}
+
+func (c *Coordinator) owned(shard int, worker string, now time.Time) bool {
+	return c.owners[shard].worker == worker && now.Before(c.owners[shard].expires)
+}
+
+func (c *Coordinator) free(shard int, now time.Time) bool {
+	return c.owners[shard].worker == "" || !now.Before(c.owners[shard].expires)
+}
+
+func (c *Coordinator) drained(shard int) bool {
+	if c.shards[shard].Len() > 0 || len(c.expired[shard]) > 0 {
+		return false
+	}
+	for _, l := range c.leases {
+		if l.shard == shard {
+			return false
+		}
+	}
+	return true
+}
+
+// Len counts queued and leased requests, so workers only finish when the whole crawl does.
+func (c *Coordinator) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expireLeases(time.Now())
+	n := len(c.leases)
+	for i, shard := range c.shards {
+		n += shard.Len() + len(c.expired[i])
+	}
+	return n
+}
+
+func (c *Coordinator) Heartbeat(worker string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.renew(worker, time.Now())
+}
+
+// renew extends the worker's shards and leases.
+func (c *Coordinator) renew(worker string, now time.Time) {
+	c.workers[worker] = now.Add(c.leaseTimeout)
+	for i := range c.owners {
+		if c.owners[i].worker == worker {
+			c.owners[i].expires = now.Add(c.leaseTimeout)
+		}
+	}
+	for _, l := range c.leases {
+		if l.worker == worker {
+			l.deadline = now.Add(c.leaseTimeout)
+		}
+	}
+}
+
+func (c *Coordinator) expireLeases(now time.Time) {
+	for key, l := range c.leases {
+		if now.After(l.deadline) {
+			glog.Warningf("Lease of '%s' by %s expired, requeuing.", key, l.worker)
+			delete(c.leases, key)
+			c.expired[l.shard] = append(c.expired[l.shard], l.req)
+		}
+	}
+}
+
+func (c *Coordinator) handlePush(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJson(w, pushReply{Queued: c.Push(&req)})
+}
+
+func (c *Coordinator) handleLease(w http.ResponseWriter, r *http.Request) {
+	if req, ok := c.Lease(r.FormValue(COORDINATOR_PARAM_WORKER)); ok {
+		writeJson(w, req)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (c *Coordinator) handleDone(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.Done(r.FormValue(COORDINATOR_PARAM_WORKER), &req)
+}
+
+func (c *Coordinator) handleRequeue(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.Requeue(r.FormValue(COORDINATOR_PARAM_WORKER), &req)
+}
+
+func (c *Coordinator) handleLen(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, lenReply{Len: c.Len()})
+}
+
+func (c *Coordinator) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	c.Heartbeat(r.FormValue(COORDINATOR_PARAM_WORKER))
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Warningf("Failed to write reply: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/yijinliu/dspider"
+)
+
+var listenFlag = flag.String("listen", ":8090", "")
+var shardsFlag = flag.Int("shards", 16, "Should be more than the number of workers.")
+var leaseTimeoutFlag = flag.Duration("lease-timeout", time.Minute,
+	"Requeue the requests of workers that didn't send heartbeats for this long.")
+var seedsFlag = flag.String("seeds", "", "Comma separated URLs to queue.")
+var frontierBaseFlag = flag.String("frontier-base", "",
+	"Keep shard N in <frontier-base>-N.sqlite3, so the crawl can be resumed.")
+var sqlDriverFlag = flag.String("sql-driver", "sqlite3", "")
+
+func main() {
+	flag.Parse()
+
+	shards := make([]dspider.Frontier, *shardsFlag)
+	for i := range shards {
+		if *frontierBaseFlag == "" {
+			shards[i] = dspider.NewMemFrontier()
+			continue
+		}
+		fileName := fmt.Sprintf("%s-%d.sqlite3", *frontierBaseFlag, i)
+		f, err := dspider.NewSqlFrontier(*sqlDriverFlag, fileName)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer f.Close()
+		shards[i] = f
+	}
+	coordinator := dspider.NewCoordinator(shards, *leaseTimeoutFlag)
+	if *seedsFlag != "" {
+		for _, seed := range strings.Split(*seedsFlag, ",") {
+			coordinator.Push(dspider.NewRequest(seed))
+		}
+	}
+	glog.Infof("Listening on %s ...", *listenFlag)
+	glog.Fatal(http.ListenAndServe(*listenFlag, coordinator))
+}
@@ -0,0 +1,106 @@
+package dspider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCoordinatorIgnoresLateRelease(t *testing.T) {
+	c := NewCoordinator([]Frontier{NewMemFrontier()}, 50*time.Millisecond)
+	c.Push(NewRequest("http://a/1"))
+	req, ok := c.Lease("old")
+	if !ok {
+		t.Fatal("nothing to lease")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := c.Lease("new"); !ok {
+		t.Fatal("the expired lease wasn't leased again")
+	}
+	c.Done("old", req)
+	if n := c.Len(); n != 1 {
+		t.Errorf("a late Done ended the new lease, Len is %d", n)
+	}
+	c.Done("new", req)
+	if n := c.Len(); n != 0 {
+		t.Errorf("Len is %d after Done, want 0", n)
+	}
+}
+
+// treeParser crawls a binary tree of pages numbered from 1, spread over hosts.
+type treeParser struct {
+	hosts  []string
+	max    int
+	mu     *sync.Mutex
+	parsed map[string]int
+}
+
+func (p *treeParser) Parse(ctx context.Context, req *Request, resp *http.Response,
+	spider Spider) error {
+	p.mu.Lock()
+	p.parsed[req.URL]++
+	p.mu.Unlock()
+	i, _ := strconv.Atoi(req.URL[strings.LastIndex(req.URL, "/")+1:])
+	for _, child := range []int{2 * i, 2*i + 1} {
+		if child <= p.max {
+			spider.QueueRequest(req.Child(p.hosts[child%len(p.hosts)] + "/" +
+				strconv.Itoa(child)))
+		}
+	}
+	return nil
+}
+
+func TestCoordinatorWorkers(t *testing.T) {
+	var hosts []string
+	for i := 0; i < 3; i++ {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(10 * time.Millisecond)
+		}))
+		defer srv.Close()
+		hosts = append(hosts, srv.URL)
+	}
+	coordinator := NewCoordinator([]Frontier{NewMemFrontier(), NewMemFrontier(),
+		NewMemFrontier(), NewMemFrontier()}, time.Second)
+	coordinatorServer := httptest.NewServer(coordinator)
+	defer coordinatorServer.Close()
+	coordinator.Push(NewRequest(hosts[1] + "/1"))
+
+	const pages = 60
+	var mu sync.Mutex
+	parsed := make(map[string]int)
+	errs := make(chan error, 3)
+	for w := 0; w < 3; w++ {
+		go func(w int) {
+			f := NewRemoteFrontier(http.DefaultClient, coordinatorServer.URL,
+				"worker"+strconv.Itoa(w), 100*time.Millisecond)
+			defer f.Close()
+			s := NewSimpleSpiderWithFrontier(http.DefaultClient, 2, &SimpleRetrier{}, f)
+			s.DisableRobots()
+			s.AddDocParser(".", &treeParser{hosts: hosts, max: pages, mu: &mu, parsed: parsed})
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			errs <- s.Run(ctx)
+		}(w)
+	}
+	for w := 0; w < 3; w++ {
+		if err := <-errs; err != nil {
+			t.Errorf("worker failed: %v", err)
+		}
+	}
+	if len(parsed) != pages {
+		t.Errorf("parsed %d pages, want %d", len(parsed), pages)
+	}
+	for urlStr, n := range parsed {
+		if n != 1 {
+			t.Errorf("parsed '%s' %d times", urlStr, n)
+		}
+	}
+	if n := coordinator.Len(); n != 0 {
+		t.Errorf("coordinator has %d requests left", n)
+	}
+}
@@ -1,9 +1,22 @@
 package dspider
 
 import (
+	"context"
 	"net/http"
 )
 
 type Crawler interface {
-	Crawl(client *http.Client, urlStr string) (*http.Response, error)
+	// Crawl should pass ctx on to the request, e.g. with Request.HTTPRequest.
+	Crawl(ctx context.Context, client *http.Client, req *Request) (*http.Response, error)
+}
+
+type defaultCrawler struct{}
+
+func (defaultCrawler) Crawl(ctx context.Context, client *http.Client, req *Request) (
+	*http.Response, error) {
+	httpReq, err := req.HTTPRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(httpReq)
 }
@@ -0,0 +1,151 @@
+package dspider
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DEAD_LETTER_TABLE_NAME = "dead_letters"
+
+	DEAD_LETTER_FETCH = "fetch"
+	DEAD_LETTER_PARSE = "parse"
+)
+
+// DeadLetter is a request that failed for good, in Stage DEAD_LETTER_FETCH or DEAD_LETTER_PARSE.
+type DeadLetter struct {
+	Request  *Request
+	Stage    string
+	Attempts int
+	Err      string
+	// StatusCode is 0 if there was no response.
+	StatusCode int
+	FailedAt   time.Time
+}
+
+func newDeadLetter(req *Request, stage string, attempts int, err error,
+	statusCode int) *DeadLetter {
+	if statusCode == 0 {
+		statusCode = statusCodeOf(err)
+	}
+	return &DeadLetter{
+		Request:    req,
+		Stage:      stage,
+		Attempts:   attempts,
+		Err:        err.Error(),
+		StatusCode: statusCode,
+		FailedAt:   time.Now(),
+	}
+}
+
+// DeadLetterStore keeps the requests SimpleSpider gave up on, see SetDeadLetterStore.
+type DeadLetterStore interface {
+	AddDeadLetter(ctx context.Context, dl *DeadLetter) error
+}
+
+// SqlDeadLetterStore keeps the latest failure of each Request.Key in the url column, with the
+// JSON encoded request in the request column.
+type SqlDeadLetterStore struct {
+	mu      sync.Mutex
+	db      *sql.DB
+	dialect Dialect
+}
+
+func NewSqlDeadLetterStore(driver, fileName string) (*SqlDeadLetterStore, error) {
+	db, err := sql.Open(driver, fileName)
+	if err != nil {
+		return nil, err
+	}
+	dialect := DialectOf(driver)
+	if err := createTable(db, dialect, SqlTableDef{
+		Name: DEAD_LETTER_TABLE_NAME,
+		Columns: map[string]string{
+			"url":        "TEXT NOT NULL",
+			"method":     "TEXT NOT NULL",
+			"request":    "TEXT NOT NULL",
+			"stage":      "TEXT NOT NULL",
+			"attempts":   "INTEGER NOT NULL",
+			"last_error": "TEXT",
+			"status":     "INTEGER",
+			"failed_at":  "TIMESTAMP NOT NULL",
+		},
+		PrimaryKeys: []string{"url"},
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SqlDeadLetterStore{db: db, dialect: dialect}, nil
+}
+
+func (s *SqlDeadLetterStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SqlDeadLetterStore) AddDeadLetter(ctx context.Context, dl *DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := dl.Request.Key()
+	data, err := json.Marshal(dl.Request)
+	if err != nil {
+		return fmt.Errorf("failed to encode '%s': %v", key, err)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, rebind(s.dialect, fmt.Sprintf("DELETE FROM %s WHERE url = ?",
+		DEAD_LETTER_TABLE_NAME)), key); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, rebind(s.dialect, fmt.Sprintf("INSERT INTO %s "+
+		"(url, method, request, stage, attempts, last_error, status, failed_at) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?)", DEAD_LETTER_TABLE_NAME)), key, dl.Request.method(),
+		string(data), dl.Stage, dl.Attempts, dl.Err, dl.StatusCode, dl.FailedAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// List returns the dead letters, oldest first.
+func (s *SqlDeadLetterStore) List() ([]*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows, err := s.db.Query(fmt.Sprintf("SELECT url, request, stage, attempts, last_error, "+
+		"status, failed_at FROM %s ORDER BY failed_at", DEAD_LETTER_TABLE_NAME))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var dls []*DeadLetter
+	for rows.Next() {
+		var key, data string
+		var lastError sql.NullString
+		var status sql.NullInt64
+		dl := &DeadLetter{}
+		if err := rows.Scan(&key, &data, &dl.Stage, &dl.Attempts, &lastError, &status,
+			&dl.FailedAt); err != nil {
+			return nil, err
+		}
+		dl.Request = NewRequest(key)
+		if err := json.Unmarshal([]byte(data), dl.Request); err != nil {
+			return nil, fmt.Errorf("failed to decode '%s': %v", key, err)
+		}
+		dl.Err, dl.StatusCode = lastError.String, int(status.Int64)
+		dls = append(dls, dl)
+	}
+	return dls, rows.Err()
+}
+
+// Remove deletes the dead letter of the request with the key.
+func (s *SqlDeadLetterStore) Remove(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.db.Exec(rebind(s.dialect, fmt.Sprintf("DELETE FROM %s WHERE url = ?",
+		DEAD_LETTER_TABLE_NAME)), key)
+	return err
+}
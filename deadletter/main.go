@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/yijinliu/dspider"
+)
+
+var deadLetterFileFlag = flag.String("dead-letter-file", "", "")
+var sqlDriverFlag = flag.String("sql-driver", "sqlite3", "")
+var frontierFileFlag = flag.String("frontier-file", "",
+	"With requeue, the SqlFrontier file to queue the failed requests in.")
+var stageFlag = flag.String("stage", "", "Only the requests that failed to fetch or parse.")
+var keepFlag = flag.Bool("keep", false, "With requeue, keep the requeued dead letters.")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] list|requeue\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *deadLetterFileFlag == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	store, err := dspider.NewSqlDeadLetterStore(*sqlDriverFlag, *deadLetterFileFlag)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer store.Close()
+	all, err := store.List()
+	if err != nil {
+		glog.Fatalf("Failed to list dead letters: %v", err)
+	}
+	var dls []*dspider.DeadLetter
+	for _, dl := range all {
+		if *stageFlag == "" || dl.Stage == *stageFlag {
+			dls = append(dls, dl)
+		}
+	}
+
+	switch flag.Arg(0) {
+	case "list":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "FAILED AT\tSTAGE\tATTEMPTS\tSTATUS\tREQUEST\tERROR")
+		for _, dl := range dls {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n", dl.FailedAt.Format(time.RFC3339),
+				dl.Stage, dl.Attempts, dl.StatusCode, dl.Request.Key(), dl.Err)
+		}
+		w.Flush()
+	case "requeue":
+		if *frontierFileFlag == "" {
+			glog.Fatalf("Please specify --frontier-file.")
+		}
+		frontier, err := dspider.NewSqlFrontier(*sqlDriverFlag, *frontierFileFlag)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer frontier.Close()
+		requeued := 0
+		for _, dl := range dls {
+			req := dl.Request
+			req.Attempts, req.FirstAttempt, req.NotBefore = 0, time.Time{}, time.Time{}
+			// A frontier that already crawled the request needs it put back.
+			var queued bool
+			if frontier.Seen(req.Key()) {
+				queued = frontier.Requeue(req)
+			} else {
+				queued = frontier.Push(req)
+			}
+			if !queued {
+				glog.Errorf("Failed to requeue '%s', keeping its dead letter.", req.Key())
+				continue
+			}
+			requeued++
+			if !*keepFlag {
+				if err := store.Remove(req.Key()); err != nil {
+					glog.Errorf("Failed to remove '%s': %v", req.Key(), err)
+				}
+			}
+		}
+		glog.Infof("Requeued %d of %d requests in '%s'.", requeued, len(dls), *frontierFileFlag)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,408 @@
+package dspider
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Dialect is what the SQL storage, frontier and dead letter store need to know about a database
+// beyond database/sql. Column definitions are written with the types INTEGER, REAL, TEXT,
+// BOOLEAN, TIMESTAMP and BLOB, which each dialect maps to its own.
+type Dialect interface {
+	// Placeholder returns the placeholder of the nth argument of a statement, from 1.
+	Placeholder(n int) string
+	Quote(ident string) string
+	// Column returns the column definition body in the dialect. key tells whether the column is
+	// a primary key or indexed.
+	Column(body string, key bool) string
+	// Insert returns the statement inserting the columns into the table of def, resolving
+	// conflicts by def.OnConflict.
+	Insert(def *SqlTableDef, columns []string) string
+	// ColumnTypes returns the types of the columns of an existing table, by upper case column
+	// name.
+	ColumnTypes(db *sql.DB, table string) (map[string]string, error)
+	// CreateIndex indexes the columns together unless they already are.
+	CreateIndex(db *sql.DB, table string, columns []string) error
+}
+
+var dialectsMu sync.RWMutex
+var dialects = map[string]Dialect{
+	"sqlite3":  SqliteDialect{},
+	"sqlite":   SqliteDialect{},
+	"postgres": PostgresDialect{},
+	"pgx":      PostgresDialect{},
+	"mysql":    MysqlDialect{},
+}
+
+// RegisterDialect makes DialectOf return d for the driver.
+func RegisterDialect(driver string, d Dialect) {
+	dialectsMu.Lock()
+	defer dialectsMu.Unlock()
+	dialects[driver] = d
+}
+
+// DialectOf returns the dialect registered for the database/sql driver, SqliteDialect if none.
+func DialectOf(driver string) Dialect {
+	dialectsMu.RLock()
+	defer dialectsMu.RUnlock()
+	if d, ok := dialects[driver]; ok {
+		return d
+	}
+	return SqliteDialect{}
+}
+
+// rebind replaces the ? placeholders of the query with the dialect's.
+func rebind(d Dialect, query string) string {
+	var buf bytes.Buffer
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			buf.WriteString(d.Placeholder(n))
+		} else {
+			buf.WriteRune(c)
+		}
+	}
+	return buf.String()
+}
+
+func quoteAll(d Dialect, idents []string) string {
+	quoted := make([]string, len(idents))
+	for i, ident := range idents {
+		quoted[i] = d.Quote(ident)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func quoteWith(ident, quote string) string {
+	return quote + strings.Replace(ident, quote, quote+quote, -1) + quote
+}
+
+func indexName(table string, columns []string) string {
+	return fmt.Sprintf("%s_%s_idx", table, strings.Join(columns, "_"))
+}
+
+var columnTypeRegexp = regexp.MustCompile(`^\s*([A-Za-z]+)`)
+
+// mapColumnType replaces the type of the column definition body by types.
+func mapColumnType(body string, types map[string]string) string {
+	m := columnTypeRegexp.FindStringSubmatchIndex(body)
+	if m == nil {
+		return body
+	}
+	typ, ok := types[strings.ToUpper(body[m[2]:m[3]])]
+	if !ok {
+		return body
+	}
+	return body[:m[2]] + typ + body[m[3]:]
+}
+
+func writeInsert(buf *bytes.Buffer, d Dialect, verb string, def *SqlTableDef, columns []string) {
+	fmt.Fprintf(buf, "%s INTO %s (%s) VALUES (", verb, d.Quote(def.Name), quoteAll(d, columns))
+	for i := range columns {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(d.Placeholder(i + 1))
+	}
+	buf.WriteString(")")
+}
+
+// writeOnConflict writes the ON CONFLICT clause that updates conflicting rows, shared by SQLite
+// and PostgreSQL.
+func writeOnConflict(buf *bytes.Buffer, d Dialect, def *SqlTableDef, columns []string) {
+	update := def.updateColumns(columns)
+	keys := quoteAll(d, def.primaryKeys())
+	if keys == "" {
+		buf.WriteString(" ON CONFLICT DO NOTHING")
+		return
+	} else if len(update) == 0 {
+		fmt.Fprintf(buf, " ON CONFLICT (%s) DO NOTHING", keys)
+		return
+	}
+	fmt.Fprintf(buf, " ON CONFLICT (%s) DO UPDATE SET ", keys)
+	for i, col := range update {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(buf, "%s = excluded.%s", d.Quote(col), d.Quote(col))
+	}
+	if newest := def.OnConflict.NewestColumn; def.OnConflict.Action == CONFLICT_KEEP_NEWEST {
+		fmt.Fprintf(buf, " WHERE %s.%s < excluded.%s", d.Quote(def.Name), d.Quote(newest),
+			d.Quote(newest))
+	}
+}
+
+// SqliteDialect is for github.com/mattn/go-sqlite3, which takes the types as they are.
+type SqliteDialect struct{}
+
+func (SqliteDialect) Placeholder(n int) string {
+	return "?"
+}
+
+func (SqliteDialect) Quote(ident string) string {
+	return quoteWith(ident, `"`)
+}
+
+func (SqliteDialect) Column(body string, key bool) string {
+	return body
+}
+
+func (d SqliteDialect) Insert(def *SqlTableDef, columns []string) string {
+	var buf bytes.Buffer
+	switch def.OnConflict.Action {
+	case CONFLICT_IGNORE:
+		writeInsert(&buf, d, "INSERT OR IGNORE", def, columns)
+	case CONFLICT_REPLACE:
+		writeInsert(&buf, d, "INSERT OR REPLACE", def, columns)
+	case CONFLICT_UPDATE, CONFLICT_KEEP_NEWEST:
+		writeInsert(&buf, d, "INSERT", def, columns)
+		writeOnConflict(&buf, d, def, columns)
+	default:
+		writeInsert(&buf, d, "INSERT", def, columns)
+	}
+	return buf.String()
+}
+
+// ColumnTypes returns the declared types.
+func (d SqliteDialect) ColumnTypes(db *sql.DB, table string) (map[string]string, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT * FROM %s WHERE 1 = 0", d.Quote(table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cts, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	types := make(map[string]string, len(cts))
+	for _, ct := range cts {
+		types[strings.ToUpper(ct.Name())] = ct.DatabaseTypeName()
+	}
+	return types, nil
+}
+
+func (d SqliteDialect) CreateIndex(db *sql.DB, table string, columns []string) error {
+	_, err := db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)",
+		d.Quote(indexName(table, columns)), d.Quote(table), quoteAll(d, columns)))
+	return err
+}
+
+// PostgresDialect is for github.com/lib/pq and github.com/jackc/pgx. Tables are looked up in the
+// current schema.
+type PostgresDialect struct{}
+
+var postgresTypes = map[string]string{
+	"INTEGER":   "BIGINT",
+	"REAL":      "DOUBLE PRECISION",
+	"TIMESTAMP": "TIMESTAMP WITH TIME ZONE",
+	"BLOB":      "BYTEA",
+}
+
+func (PostgresDialect) Placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+func (PostgresDialect) Quote(ident string) string {
+	return quoteWith(ident, `"`)
+}
+
+func (PostgresDialect) Column(body string, key bool) string {
+	return mapColumnType(body, postgresTypes)
+}
+
+// Insert updates all the columns of conflicting rows to replace them, which PostgreSQL can't.
+func (d PostgresDialect) Insert(def *SqlTableDef, columns []string) string {
+	var buf bytes.Buffer
+	writeInsert(&buf, d, "INSERT", def, columns)
+	switch def.OnConflict.Action {
+	case CONFLICT_IGNORE:
+		buf.WriteString(" ON CONFLICT DO NOTHING")
+	case CONFLICT_REPLACE, CONFLICT_UPDATE, CONFLICT_KEEP_NEWEST:
+		writeOnConflict(&buf, d, def, columns)
+	}
+	return buf.String()
+}
+
+func (d PostgresDialect) ColumnTypes(db *sql.DB, table string) (map[string]string, error) {
+	return queryColumnTypes(db, "SELECT column_name, data_type FROM information_schema.columns "+
+		"WHERE table_schema = current_schema() AND table_name = $1", table)
+}
+
+func (d PostgresDialect) CreateIndex(db *sql.DB, table string, columns []string) error {
+	_, err := db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)",
+		d.Quote(indexName(table, columns)), d.Quote(table), quoteAll(d, columns)))
+	return err
+}
+
+// MysqlDialect is for github.com/go-sql-driver/mysql, whose DSN needs parseTime=true to read
+// TIMESTAMP columns. TEXT columns that are keys or have a DEFAULT are VARCHAR(768), the longest
+// that utf8mb4 indexes take, as MySQL can neither index nor default TEXT. So keys can't be
+// longer than 768 characters, e.g. the URLs of SqlFrontier and SqlDeadLetterStore, and indexes
+// over several such columns only index their prefixes.
+type MysqlDialect struct{}
+
+// MYSQL_MAX_KEY_BYTES is how long InnoDB index keys can be.
+const MYSQL_MAX_KEY_BYTES = 3072
+
+var mysqlTypes = map[string]string{
+	"INTEGER":   "BIGINT",
+	"REAL":      "DOUBLE",
+	"BOOLEAN":   "TINYINT(1)",
+	"TIMESTAMP": "DATETIME(6)",
+	"BLOB":      "LONGBLOB",
+}
+
+var mysqlKeyTypes = map[string]string{
+	"INTEGER":   "BIGINT",
+	"REAL":      "DOUBLE",
+	"TEXT":      "VARCHAR(768)",
+	"BOOLEAN":   "TINYINT(1)",
+	"TIMESTAMP": "DATETIME(6)",
+	"BLOB":      "VARBINARY(3072)",
+}
+
+func (MysqlDialect) Placeholder(n int) string {
+	return "?"
+}
+
+func (MysqlDialect) Quote(ident string) string {
+	return quoteWith(ident, "`")
+}
+
+func (MysqlDialect) Column(body string, key bool) string {
+	if key || strings.Contains(strings.ToUpper(body), "DEFAULT") {
+		return mapColumnType(body, mysqlKeyTypes)
+	}
+	return mapColumnType(body, mysqlTypes)
+}
+
+// Insert resolves conflicts on any unique key, not only the primary one.
+func (d MysqlDialect) Insert(def *SqlTableDef, columns []string) string {
+	p := def.OnConflict
+	update := def.updateColumns(columns)
+	// Rows without the newest column can't be newer, like with SQLite and PostgreSQL.
+	newestInserted := false
+	for _, col := range columns {
+		newestInserted = newestInserted || col == p.NewestColumn
+	}
+	var buf bytes.Buffer
+	switch {
+	case p.Action == CONFLICT_IGNORE || p.Action == CONFLICT_UPDATE && len(update) == 0 ||
+		p.Action == CONFLICT_KEEP_NEWEST && (len(update) == 0 || !newestInserted):
+		writeInsert(&buf, d, "INSERT IGNORE", def, columns)
+	case p.Action == CONFLICT_REPLACE:
+		writeInsert(&buf, d, "REPLACE", def, columns)
+	case p.Action == CONFLICT_UPDATE:
+		writeInsert(&buf, d, "INSERT", def, columns)
+		buf.WriteString(" ON DUPLICATE KEY UPDATE ")
+		for i, col := range update {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(&buf, "%s = VALUES(%s)", d.Quote(col), d.Quote(col))
+		}
+	case p.Action == CONFLICT_KEEP_NEWEST:
+		writeInsert(&buf, d, "INSERT", def, columns)
+		// The newest column must be compared before it's updated, so it goes last.
+		buf.WriteString(" ON DUPLICATE KEY UPDATE ")
+		newest := d.Quote(p.NewestColumn)
+		for _, col := range update {
+			if col != p.NewestColumn {
+				col = d.Quote(col)
+				fmt.Fprintf(&buf, "%s = IF(VALUES(%s) > %s, VALUES(%s), %s), ", col, newest,
+					newest, col, col)
+			}
+		}
+		fmt.Fprintf(&buf, "%s = GREATEST(%s, VALUES(%s))", newest, newest, newest)
+	default:
+		writeInsert(&buf, d, "INSERT", def, columns)
+	}
+	return buf.String()
+}
+
+func (d MysqlDialect) ColumnTypes(db *sql.DB, table string) (map[string]string, error) {
+	return queryColumnTypes(db, "SELECT column_name, data_type FROM information_schema.columns "+
+		"WHERE table_schema = DATABASE() AND table_name = ?", table)
+}
+
+// CreateIndex checks for the index first, as MySQL has no CREATE INDEX IF NOT EXISTS.
+func (d MysqlDialect) CreateIndex(db *sql.DB, table string, columns []string) error {
+	name := indexName(table, columns)
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM information_schema.statistics "+
+		"WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?", table,
+		name).Scan(&n); err != nil || n > 0 {
+		return err
+	}
+	lengths := make(map[string]int64)
+	rows, err := db.Query("SELECT column_name, character_maximum_length "+
+		"FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ?",
+		table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var col string
+		var length sql.NullInt64
+		if err := rows.Scan(&col, &length); err != nil {
+			return err
+		}
+		if length.Valid {
+			lengths[strings.ToUpper(col)] = length.Int64
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("CREATE INDEX %s ON %s (%s)", d.Quote(name), d.Quote(table),
+		mysqlIndexColumns(d, columns, lengths)))
+	return err
+}
+
+// mysqlIndexColumns indexes prefixes of the character columns, whose lengths are given, so
+// that keys fit in MYSQL_MAX_KEY_BYTES. Other columns take at most 8 bytes and characters 4.
+func mysqlIndexColumns(d MysqlDialect, columns []string, lengths map[string]int64) string {
+	chars := 0
+	for _, col := range columns {
+		if _, ok := lengths[strings.ToUpper(col)]; ok {
+			chars++
+		}
+	}
+	var prefix int64
+	if chars > 0 {
+		prefix = int64((MYSQL_MAX_KEY_BYTES - 8*(len(columns)-chars)) / 4 / chars)
+	}
+	quoted := make([]string, len(columns))
+	for i, col := range columns {
+		quoted[i] = d.Quote(col)
+		if length, ok := lengths[strings.ToUpper(col)]; ok && length > prefix {
+			quoted[i] += fmt.Sprintf("(%d)", prefix)
+		}
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// queryColumnTypes reads the column names and types from an information_schema query.
+func queryColumnTypes(db *sql.DB, query, table string) (map[string]string, error) {
+	rows, err := db.Query(query, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	types := make(map[string]string)
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		types[strings.ToUpper(name)] = strings.ToUpper(typ)
+	}
+	return types, rows.Err()
+}
@@ -0,0 +1,357 @@
+package dspider
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func dialectTableDef(action int) SqlTableDef {
+	return SqlTableDef{
+		Name: "group",
+		Columns: map[string]string{
+			"id":    "INTEGER",
+			"desc":  "TEXT",
+			"order": "INTEGER",
+		},
+		PrimaryKeys: []string{"id"},
+		OnConflict:  ConflictPolicy{Action: action, NewestColumn: "order"},
+	}
+}
+
+func TestDialectInsert(t *testing.T) {
+	all := []string{"desc", "id", "order"}
+	keyOnly := []string{"id"}
+	for _, test := range []struct {
+		driver  string
+		action  int
+		columns []string
+		want    string
+	}{
+		{"sqlite3", CONFLICT_ERROR, all,
+			`INSERT INTO "group" ("desc", "id", "order") VALUES (?, ?, ?)`},
+		{"sqlite3", CONFLICT_IGNORE, all,
+			`INSERT OR IGNORE INTO "group" ("desc", "id", "order") VALUES (?, ?, ?)`},
+		{"sqlite3", CONFLICT_REPLACE, all,
+			`INSERT OR REPLACE INTO "group" ("desc", "id", "order") VALUES (?, ?, ?)`},
+		{"sqlite3", CONFLICT_UPDATE, all,
+			`INSERT INTO "group" ("desc", "id", "order") VALUES (?, ?, ?) ON CONFLICT ("id") ` +
+				`DO UPDATE SET "desc" = excluded."desc", "order" = excluded."order"`},
+		{"sqlite3", CONFLICT_UPDATE, keyOnly,
+			`INSERT INTO "group" ("id") VALUES (?) ON CONFLICT ("id") DO NOTHING`},
+		{"sqlite3", CONFLICT_KEEP_NEWEST, all,
+			`INSERT INTO "group" ("desc", "id", "order") VALUES (?, ?, ?) ON CONFLICT ("id") ` +
+				`DO UPDATE SET "desc" = excluded."desc", "order" = excluded."order" ` +
+				`WHERE "group"."order" < excluded."order"`},
+		{"sqlite3", CONFLICT_KEEP_NEWEST, keyOnly,
+			`INSERT INTO "group" ("id") VALUES (?) ON CONFLICT ("id") DO NOTHING`},
+
+		{"postgres", CONFLICT_ERROR, all,
+			`INSERT INTO "group" ("desc", "id", "order") VALUES ($1, $2, $3)`},
+		{"postgres", CONFLICT_IGNORE, all,
+			`INSERT INTO "group" ("desc", "id", "order") VALUES ($1, $2, $3) ` +
+				`ON CONFLICT DO NOTHING`},
+		{"postgres", CONFLICT_REPLACE, all,
+			`INSERT INTO "group" ("desc", "id", "order") VALUES ($1, $2, $3) ON CONFLICT ("id") ` +
+				`DO UPDATE SET "desc" = excluded."desc", "order" = excluded."order"`},
+		{"postgres", CONFLICT_REPLACE, keyOnly,
+			`INSERT INTO "group" ("id") VALUES ($1) ON CONFLICT ("id") DO NOTHING`},
+		{"postgres", CONFLICT_UPDATE, all,
+			`INSERT INTO "group" ("desc", "id", "order") VALUES ($1, $2, $3) ON CONFLICT ("id") ` +
+				`DO UPDATE SET "desc" = excluded."desc", "order" = excluded."order"`},
+		{"postgres", CONFLICT_UPDATE, keyOnly,
+			`INSERT INTO "group" ("id") VALUES ($1) ON CONFLICT ("id") DO NOTHING`},
+		{"postgres", CONFLICT_KEEP_NEWEST, all,
+			`INSERT INTO "group" ("desc", "id", "order") VALUES ($1, $2, $3) ON CONFLICT ("id") ` +
+				`DO UPDATE SET "desc" = excluded."desc", "order" = excluded."order" ` +
+				`WHERE "group"."order" < excluded."order"`},
+		{"postgres", CONFLICT_KEEP_NEWEST, keyOnly,
+			`INSERT INTO "group" ("id") VALUES ($1) ON CONFLICT ("id") DO NOTHING`},
+
+		{"mysql", CONFLICT_ERROR, all,
+			"INSERT INTO `group` (`desc`, `id`, `order`) VALUES (?, ?, ?)"},
+		{"mysql", CONFLICT_IGNORE, all,
+			"INSERT IGNORE INTO `group` (`desc`, `id`, `order`) VALUES (?, ?, ?)"},
+		{"mysql", CONFLICT_REPLACE, all,
+			"REPLACE INTO `group` (`desc`, `id`, `order`) VALUES (?, ?, ?)"},
+		{"mysql", CONFLICT_UPDATE, all,
+			"INSERT INTO `group` (`desc`, `id`, `order`) VALUES (?, ?, ?) " +
+				"ON DUPLICATE KEY UPDATE `desc` = VALUES(`desc`), `order` = VALUES(`order`)"},
+		{"mysql", CONFLICT_UPDATE, keyOnly,
+			"INSERT IGNORE INTO `group` (`id`) VALUES (?)"},
+		{"mysql", CONFLICT_KEEP_NEWEST, all,
+			"INSERT INTO `group` (`desc`, `id`, `order`) VALUES (?, ?, ?) " +
+				"ON DUPLICATE KEY UPDATE `desc` = IF(VALUES(`order`) > `order`, VALUES(`desc`), " +
+				"`desc`), `order` = GREATEST(`order`, VALUES(`order`))"},
+		{"mysql", CONFLICT_KEEP_NEWEST, []string{"desc", "id"},
+			"INSERT IGNORE INTO `group` (`desc`, `id`) VALUES (?, ?)"},
+	} {
+		def := dialectTableDef(test.action)
+		if got := DialectOf(test.driver).Insert(&def, test.columns); got != test.want {
+			t.Errorf("%s action %d %v:\n got %s\nwant %s", test.driver, test.action,
+				test.columns, got, test.want)
+		}
+	}
+
+	// PostgreSQL can't replace the rows of a table without a key.
+	def := dialectTableDef(CONFLICT_REPLACE)
+	def.PrimaryKeys = nil
+	d := DialectOf("postgres")
+	if err := def.checkConflictPolicy(d); err == nil {
+		t.Error("a PostgreSQL table without a key replaces conflicting rows")
+	}
+	want := `INSERT INTO "group" ("desc", "id") VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	if got := d.Insert(&def, []string{"desc", "id"}); got != want {
+		t.Errorf("\n got %s\nwant %s", got, want)
+	}
+	for _, driver := range []string{"sqlite3", "mysql"} {
+		if err := def.checkConflictPolicy(DialectOf(driver)); err != nil {
+			t.Errorf("%s: %v", driver, err)
+		}
+	}
+}
+
+func TestDialectColumn(t *testing.T) {
+	for _, test := range []struct {
+		driver string
+		body   string
+		key    bool
+		want   string
+	}{
+		{"sqlite3", "INTEGER PRIMARY KEY", false, "INTEGER PRIMARY KEY"},
+		{"sqlite3", "REAL", false, "REAL"},
+		{"sqlite3", "TEXT NOT NULL DEFAULT ''", false, "TEXT NOT NULL DEFAULT ''"},
+		{"sqlite3", "TIMESTAMP NOT NULL", false, "TIMESTAMP NOT NULL"},
+		{"sqlite3", "TEXT NOT NULL", true, "TEXT NOT NULL"},
+
+		{"postgres", "INTEGER PRIMARY KEY", false, "BIGINT PRIMARY KEY"},
+		{"postgres", "REAL", false, "DOUBLE PRECISION"},
+		{"postgres", "TEXT NOT NULL DEFAULT ''", false, "TEXT NOT NULL DEFAULT ''"},
+		{"postgres", "TIMESTAMP NOT NULL", false, "TIMESTAMP WITH TIME ZONE NOT NULL"},
+		{"postgres", "BOOLEAN", false, "BOOLEAN"},
+		{"postgres", "BLOB", false, "BYTEA"},
+		{"postgres", "DECIMAL(10,2)", false, "DECIMAL(10,2)"},
+		{"postgres", "text not null", true, "text not null"},
+
+		{"mysql", "INTEGER PRIMARY KEY", false, "BIGINT PRIMARY KEY"},
+		{"mysql", "REAL", false, "DOUBLE"},
+		{"mysql", "TEXT", false, "TEXT"},
+		{"mysql", "TEXT NOT NULL DEFAULT ''", false, "VARCHAR(768) NOT NULL DEFAULT ''"},
+		{"mysql", "TIMESTAMP NOT NULL", false, "DATETIME(6) NOT NULL"},
+		{"mysql", "BOOLEAN", false, "TINYINT(1)"},
+		{"mysql", "BLOB", false, "LONGBLOB"},
+		{"mysql", "BLOB", true, "VARBINARY(3072)"},
+		{"mysql", "DECIMAL(10,2)", false, "DECIMAL(10,2)"},
+		{"mysql", "text not null", true, "VARCHAR(768) not null"},
+	} {
+		if got := DialectOf(test.driver).Column(test.body, test.key); got != test.want {
+			t.Errorf("%s column %q key %v: got %q, want %q", test.driver, test.body, test.key,
+				got, test.want)
+		}
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := "UPDATE t SET a = ? WHERE b = ? AND c > ?"
+	for _, test := range []struct {
+		driver string
+		want   string
+	}{
+		{"sqlite3", query},
+		{"postgres", "UPDATE t SET a = $1 WHERE b = $2 AND c > $3"},
+		{"mysql", query},
+	} {
+		if got := rebind(DialectOf(test.driver), query); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.driver, got, test.want)
+		}
+	}
+}
+
+func TestDialectQuote(t *testing.T) {
+	for _, test := range []struct {
+		driver, ident, want string
+	}{
+		{"sqlite3", `a"b`, `"a""b"`},
+		{"postgres", "desc", `"desc"`},
+		{"mysql", "a`b", "`a``b`"},
+	} {
+		if got := DialectOf(test.driver).Quote(test.ident); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.driver, got, test.want)
+		}
+	}
+}
+
+func TestMysqlIndexColumns(t *testing.T) {
+	d := MysqlDialect{}
+	for _, test := range []struct {
+		columns []string
+		lengths map[string]int64
+		want    string
+	}{
+		{[]string{"url"}, map[string]int64{"URL": 768}, "`url`"},
+		{[]string{"seq"}, map[string]int64{}, "`seq`"},
+		// The frontier's index would be 3096 bytes long.
+		{[]string{"state", "host", "priority", "seq"}, map[string]int64{"HOST": 768},
+			"`state`, `host`(762), `priority`, `seq`"},
+		{[]string{"a", "b", "c"}, map[string]int64{"A": 768, "B": 100, "C": 65535},
+			"`a`(256), `b`, `c`(256)"},
+	} {
+		if got := mysqlIndexColumns(d, test.columns, test.lengths); got != test.want {
+			t.Errorf("%v: got %s, want %s", test.columns, got, test.want)
+		}
+	}
+}
+
+func TestDialectOf(t *testing.T) {
+	if _, ok := DialectOf("unknown").(SqliteDialect); !ok {
+		t.Errorf("unknown drivers should default to SqliteDialect")
+	}
+	RegisterDialect("test-mysql", MysqlDialect{})
+	if _, ok := DialectOf("test-mysql").(MysqlDialect); !ok {
+		t.Errorf("RegisterDialect didn't register")
+	}
+}
+
+type dialectRow struct {
+	Table string `sql:"table"`
+	ID    int64  `sql:"id,pk"`
+	Desc  string `sql:"desc"`
+	Order int64  `sql:"order"`
+}
+
+func sqliteDataSource(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "dialect.db")
+}
+
+func TestSqliteConflictRoundTrip(t *testing.T) {
+	testConflictRoundTrip(t, "sqlite3", sqliteDataSource(t), "group")
+}
+
+func TestSqliteMigrateRoundTrip(t *testing.T) {
+	testMigrateRoundTrip(t, "sqlite3", sqliteDataSource(t), "group")
+}
+
+// testConflictRoundTrip writes conflicting rows into table and table_newest, which the caller
+// drops if needed.
+func testConflictRoundTrip(t *testing.T, driver, dataSource, table string) {
+	for _, test := range []struct {
+		action    int
+		table     string
+		rows      []dialectRow
+		wantDesc  string
+		wantOrder int64
+	}{
+		{CONFLICT_UPDATE, table, []dialectRow{{ID: 1, Desc: "a", Order: 1},
+			{ID: 1, Desc: "b", Order: 2}, {ID: 1, Desc: "c", Order: 0}}, "c", 0},
+		{CONFLICT_KEEP_NEWEST, table + "_newest", []dialectRow{{ID: 1, Desc: "a", Order: 1},
+			{ID: 1, Desc: "b", Order: 2}, {ID: 1, Desc: "c", Order: 0}}, "b", 2},
+	} {
+		s, err := NewSqlStorage(driver, dataSource, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RegisterStruct(SqlTableDef{
+			Name:       test.table,
+			OnConflict: ConflictPolicy{Action: test.action, NewestColumn: "order"},
+		}, &dialectRow{}); err != nil {
+			s.Close()
+			t.Fatal(err)
+		}
+		for _, row := range test.rows {
+			row.Table = test.table
+			if err := s.AddDoc(context.Background(), &row); err != nil {
+				t.Errorf("action %d: failed to add %+v: %v", test.action, row, err)
+			}
+		}
+		d := s.dialect
+		var desc string
+		var order int64
+		if err := s.db.QueryRow(rebind(d, fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s = ?",
+			d.Quote("desc"), d.Quote("order"), d.Quote(test.table), d.Quote("id"))),
+			1).Scan(&desc, &order); err != nil {
+			t.Errorf("action %d: %v", test.action, err)
+		} else if desc != test.wantDesc || order != test.wantOrder {
+			t.Errorf("action %d: got (%s, %d), want (%s, %d)", test.action, desc, order,
+				test.wantDesc, test.wantOrder)
+		}
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// testMigrateRoundTrip creates table, then migrates it to more columns.
+func testMigrateRoundTrip(t *testing.T, driver, dataSource, table string) {
+	db, err := sql.Open(driver, dataSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	d := DialectOf(driver)
+	def := SqlTableDef{
+		Name:        table,
+		Columns:     map[string]string{"id": "INTEGER", "desc": "TEXT"},
+		PrimaryKeys: []string{"id"},
+	}
+	if err := createTable(db, d, def); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(rebind(d, fmt.Sprintf("INSERT INTO %s (%s, %s) VALUES (?, ?)",
+		d.Quote(table), d.Quote("id"), d.Quote("desc"))), 1, "a"); err != nil {
+		t.Fatal(err)
+	}
+	def.Columns = map[string]string{
+		"id":    "INTEGER",
+		"desc":  "TEXT",
+		"order": "INTEGER NOT NULL",
+		"note":  "TEXT NOT NULL DEFAULT ''",
+		"at":    "TIMESTAMP",
+	}
+	def.Indexes = []string{"note"}
+	keys := map[string]bool{"id": true, "note": true}
+	if err := migrateTable(db, d, def, keys); err != nil {
+		t.Fatal(err)
+	}
+	// Migrating again changes nothing.
+	if err := createTable(db, d, def); err != nil {
+		t.Fatal(err)
+	}
+	types, err := d.ColumnTypes(db, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(types) != len(def.Columns) {
+		t.Errorf("got columns %v, want %v", types, def.Columns)
+	}
+	for col, body := range def.Columns {
+		want := baseType(d.Column(body, keys[col]))
+		if got := baseType(types[strings.ToUpper(col)]); got != want {
+			t.Errorf("column %s is %q, want %q", col, got, want)
+		}
+	}
+	var version int
+	var columns string
+	if err := db.QueryRow(rebind(d, fmt.Sprintf(
+		"SELECT version, columns FROM %s WHERE table_name = ?", SCHEMA_TABLE_NAME)),
+		table).Scan(&version, &columns); err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 || columns != "at,desc,id,note,order" {
+		t.Errorf("got schema version %d of %s, want 2 of at,desc,id,note,order", version,
+			columns)
+	}
+	var note string
+	var order sql.NullInt64
+	if err := db.QueryRow(fmt.Sprintf("SELECT %s, %s FROM %s", d.Quote("note"),
+		d.Quote("order"), d.Quote(table))).Scan(&note, &order); err != nil {
+		t.Fatal(err)
+	}
+	if note != "" || order.Valid {
+		t.Errorf("existing row got note %q and order %v, want '' and NULL", note, order)
+	}
+}
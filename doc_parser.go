@@ -1,9 +1,38 @@
 package dspider
 
 import (
+	"context"
 	"net/http"
 )
 
+type FailureAction int
+
+const (
+	// FAILURE_SKIP gives up on the request.
+	FAILURE_SKIP FailureAction = iota
+	// FAILURE_REQUEUE puts the request back in the frontier, to be crawled after its NotBefore.
+	FAILURE_REQUEUE
+	// FAILURE_ABORT stops the crawl, like Spider.Shutdown.
+	FAILURE_ABORT
+)
+
 type DocParser interface {
-	Parse(urlStr string, resp *http.Response, spider Spider) error
+	// ctx is cancelled when the spider is shutting down and gives up on in-flight crawls.
+	// resp is nil if the crawl failed, unless the DocParser is a FailureHandler.
+	Parse(ctx context.Context, req *Request, resp *http.Response, spider Spider) error
+}
+
+// Failure is a crawl that failed after all retries.
+type Failure struct {
+	Err error
+	// Attempts counts all the attempts, including those before the request was requeued.
+	Attempts int
+	// StatusCode is the status of the last response, 0 if there was none.
+	StatusCode int
+}
+
+// DocParsers that implement FailureHandler are told about failed crawls with HandleFailure,
+// instead of Parse with a nil response.
+type FailureHandler interface {
+	HandleFailure(ctx context.Context, req *Request, f *Failure, spider Spider) FailureAction
 }
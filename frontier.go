@@ -0,0 +1,180 @@
+package dspider
+
+import (
+	"container/heap"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Frontier holds the requests waiting to be crawled. Implementations must be safe for
+// concurrent use, since SimpleSpider calls MarkDone from its crawl goroutines. They don't
+// need to block; SimpleSpider waits for new requests itself.
+type Frontier interface {
+	// Push returns false if the request was dropped, e.g. because its Key was seen before.
+	Push(req *Request) bool
+	// Pop skips requests whose NotBefore hasn't come yet. Len still counts them.
+	Pop() (req *Request, ok bool)
+	Len() int
+	// MarkDone is called once a popped request has been crawled and parsed.
+	MarkDone(req *Request)
+	// Requeue puts back a popped request whose crawl failed and is retried after req.NotBefore.
+	// It's not de-duplicated, and returns false if the request couldn't be put back.
+	Requeue(req *Request) bool
+}
+
+// Frontiers that other processes push to, like RemoteFrontier, implement PollInterval.
+// SimpleSpider checks them that often for new requests and for the end of the crawl.
+type polledFrontier interface {
+	PollInterval() time.Duration
+}
+
+func hostOf(urlStr string) string {
+	if urlObj, err := url.Parse(urlStr); err == nil {
+		return urlObj.Host
+	}
+	return ""
+}
+
+type queuedRequest struct {
+	req *Request
+	seq int64
+}
+
+// requestHeap pops the highest priority first, and the earliest pushed among equals.
+type requestHeap []queuedRequest
+
+func (h requestHeap) Len() int { return len(h) }
+
+func (h requestHeap) Less(i, j int) bool {
+	if h[i].req.Priority != h[j].req.Priority {
+		return h[i].req.Priority > h[j].req.Priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h requestHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *requestHeap) Push(x interface{}) { *h = append(*h, x.(queuedRequest)) }
+
+func (h *requestHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = queuedRequest{}
+	*h = old[:n-1]
+	return x
+}
+
+// delayHeap pops the request with the earliest NotBefore first.
+type delayHeap []*Request
+
+func (h delayHeap) Len() int { return len(h) }
+
+func (h delayHeap) Less(i, j int) bool { return h[i].NotBefore.Before(h[j].NotBefore) }
+
+func (h delayHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *delayHeap) Push(x interface{}) { *h = append(*h, x.(*Request)) }
+
+func (h *delayHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return x
+}
+
+type hostQueue struct {
+	host     string
+	requests requestHeap
+}
+
+// MemFrontier takes turns between hosts, so one big site doesn't starve the others. Each host's
+// requests are popped by priority.
+type MemFrontier struct {
+	mu    sync.Mutex
+	seen  map[string]bool
+	hosts map[string]*hostQueue
+	// Hosts with queued requests, in the order they take turns.
+	ring []*hostQueue
+	next int
+	// Requeued requests that aren't due yet.
+	delayed delayHeap
+	n       int
+	seq     int64
+}
+
+func NewMemFrontier() *MemFrontier {
+	return &MemFrontier{
+		seen:  make(map[string]bool),
+		hosts: make(map[string]*hostQueue),
+	}
+}
+
+func (f *MemFrontier) Push(req *Request) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := req.Key()
+	if f.seen[key] {
+		return false
+	}
+	f.seen[key] = true
+	f.add(req)
+	f.n++
+	return true
+}
+
+func (f *MemFrontier) add(req *Request) {
+	host := hostOf(req.URL)
+	q := f.hosts[host]
+	if q == nil {
+		q = &hostQueue{host: host}
+		f.hosts[host] = q
+		f.ring = append(f.ring, q)
+	}
+	heap.Push(&q.requests, queuedRequest{req: req, seq: f.seq})
+	f.seq++
+}
+
+func (f *MemFrontier) Pop() (*Request, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	for len(f.delayed) > 0 && !f.delayed[0].NotBefore.After(now) {
+		f.add(heap.Pop(&f.delayed).(*Request))
+	}
+	if len(f.ring) == 0 {
+		return nil, false
+	}
+	if f.next >= len(f.ring) {
+		f.next = 0
+	}
+	q := f.ring[f.next]
+	req := heap.Pop(&q.requests).(queuedRequest).req
+	if len(q.requests) == 0 {
+		delete(f.hosts, q.host)
+		f.ring = append(f.ring[:f.next], f.ring[f.next+1:]...)
+	} else {
+		f.next++
+	}
+	f.n--
+	return req, true
+}
+
+func (f *MemFrontier) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.n
+}
+
+func (f *MemFrontier) MarkDone(req *Request) {}
+
+func (f *MemFrontier) Requeue(req *Request) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	heap.Push(&f.delayed, req)
+	f.n++
+	return true
+}
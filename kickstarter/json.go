@@ -1,12 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
-	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -15,11 +15,15 @@ import (
 
 const (
 	PROJECTS_TABLE_NAME = "projects"
+
+	META_CATEGORY = "category"
+	META_PAGE     = "page"
+
+	MAX_THROTTLED_ATTEMPTS  = 10
+	THROTTLED_REQUEUE_DELAY = 5 * time.Minute
 )
 
-type JsonParser struct {
-	wg sync.WaitGroup
-}
+type JsonParser struct{}
 
 type CreatorJson struct {
 	ID   int    `json:"id"`
@@ -78,26 +82,40 @@ type ProjectsJson struct {
 
 type SQLRow struct {
 	Table        string    `sql:"table"`
-	ID           int       `sql:"id"`
-	Name         string    `sql:"name"`
+	ID           int       `sql:"id,pk"`
+	Name         string    `sql:"name,notnull"`
 	Desc         string    `sql:"desc"`
-	Goal         float64   `sql:"goal"`
-	Pledged      float64   `sql:"pledged"`
-	Currency     string    `sql:"currency"`
-	USDRate      float64   `sql:"usd_rate"`
-	Country      string    `sql:"country"`
+	Goal         float64   `sql:"goal,notnull"`
+	Pledged      float64   `sql:"pledged,notnull"`
+	Currency     string    `sql:"currency,notnull"`
+	USDRate      float64   `sql:"usd_rate,notnull"`
+	Country      string    `sql:"country,notnull"`
 	BackersCount int       `sql:"backers_count"`
-	CreatedAt    time.Time `sql:"created_at"`
-	LaunchedAt   time.Time `sql:"launched_at"`
-	Deadline     time.Time `sql:"deadline"`
-	Category     string    `sql:"category"`
-	Slug         string    `sql:"slug"`
+	CreatedAt    time.Time `sql:"created_at,notnull"`
+	LaunchedAt   time.Time `sql:"launched_at,notnull"`
+	Deadline     time.Time `sql:"deadline,notnull"`
+	Category     string    `sql:"category,index"`
+	Slug         string    `sql:"slug,index"`
 	URL          string    `sql:"url"`
 }
 
-func (p *JsonParser) Parse(urlStr string, resp *http.Response, spider dspider.Spider) error {
-	if resp == nil || resp.StatusCode != http.StatusOK {
-		p.wg.Done()
+// HandleFailure comes back later to pages that failed because Kickstarter throttled us, and
+// skips the others.
+func (p *JsonParser) HandleFailure(ctx context.Context, req *dspider.Request,
+	f *dspider.Failure, spider dspider.Spider) dspider.FailureAction {
+	throttled := f.StatusCode == http.StatusTooManyRequests ||
+		f.StatusCode == http.StatusServiceUnavailable
+	if throttled && f.Attempts < MAX_THROTTLED_ATTEMPTS {
+		req.NotBefore = time.Now().Add(THROTTLED_REQUEUE_DELAY)
+		return dspider.FAILURE_REQUEUE
+	}
+	glog.Warningf("Skipping %s page %s: %v", req.Meta[META_CATEGORY], req.Meta[META_PAGE], f.Err)
+	return dspider.FAILURE_SKIP
+}
+
+func (p *JsonParser) Parse(ctx context.Context, req *dspider.Request, resp *http.Response,
+	spider dspider.Spider) error {
+	if resp.StatusCode != http.StatusOK {
 		return nil
 	}
 	var projects ProjectsJson
@@ -110,7 +128,8 @@ func (p *JsonParser) Parse(urlStr string, resp *http.Response, spider dspider.Sp
 		if project.State == "live" {
 			continue
 		}
-		glog.V(2).Infof("Adding project %d/%s ...", project.ID, project.Name)
+		glog.V(2).Infof("Adding project %d/%s from %s page %s ...", project.ID, project.Name,
+			req.Meta[META_CATEGORY], req.Meta[META_PAGE])
 		row := &SQLRow{
 			Table:        PROJECTS_TABLE_NAME,
 			ID:           project.ID,
@@ -129,14 +148,14 @@ func (p *JsonParser) Parse(urlStr string, resp *http.Response, spider dspider.Sp
 			Slug:         project.Category.Slug,
 			URL:          project.URLs.Web.Project,
 		}
-		if err := spider.AddDoc(row.URL, row); err != nil {
+		if err := spider.AddDoc(ctx, row.URL, row); err != nil {
 			glog.Warningf("Failed to add '%s': %v", row.URL, err)
 		}
 	}
 
 	if projects.HasMore {
 		// Crawl next page.
-		urlObj, _ := url.Parse(urlStr)
+		urlObj, _ := url.Parse(req.URL)
 		q := urlObj.Query()
 		page := q.Get("page")
 		if page == "" {
@@ -148,9 +167,7 @@ func (p *JsonParser) Parse(urlStr string, resp *http.Response, spider dspider.Sp
 			q.Set("page", strconv.Itoa(ipage+1))
 		}
 		urlObj.RawQuery = q.Encode()
-		go spider.Queue(urlObj.String())
-	} else {
-		p.wg.Done()
+		spider.QueueRequest(req.Child(urlObj.String()).SetMeta(META_PAGE, q.Get("page")))
 	}
 
 	return nil
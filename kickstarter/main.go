@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
@@ -14,52 +18,135 @@ import (
 var maxConcurrentCrawlsFlag = flag.Int("max-concurrent-crawls", 2, "")
 var maxCrawlRetriesFlag = flag.Int("max-crawl-retries", 3, "")
 var crawlRetryIntervalFlag = flag.Duration("crawl-retry-interval", 3*time.Second, "")
+var maxDepthFlag = flag.Int("max-depth", 0, "How many pages to follow from the seed, 0 for all.")
+var ignoreRobotsFlag = flag.Bool("ignore-robots", false, "Don't obey robots.txt.")
+var autoThrottleFlag = flag.Float64("auto-throttle", 0,
+	"Adapt the crawl rate to keep this many requests in flight per host, 0 to disable.")
+var deadLetterFileFlag = flag.String("dead-letter-file", "",
+	"Keep the requests that failed for good in this file, see the deadletter command.")
+var userAgentFlag = flag.String("user-agent", "", "User-Agent header, also used for robots.txt.")
+var crawlDelayFlag = flag.Duration("crawl-delay", 0, "Minimum delay between requests to a host.")
 var outputFileFlag = flag.String("output-file", "", "")
 var sqlDriverFlag = flag.String("sql-driver", "sqlite3", "")
+var sqlBatchSizeFlag = flag.Int("sql-batch-size", 100,
+	"Write projects in transactions of this many rows, 0 to write them one by one.")
+var shutdownTimeoutFlag = flag.Duration("shutdown-timeout", 10*time.Second,
+	"How long to wait for in-flight crawls when interrupted.")
+var coordinatorFlag = flag.String("coordinator", "",
+	"Run as a worker of the coordinator at this URL, e.g. http://localhost:8090.")
+var workerIDFlag = flag.String("worker-id", "", "Defaults to <hostname>-<pid>.")
+var metricsListenFlag = flag.String("metrics-listen", "",
+	"Serve Prometheus metrics at /metrics on this address, e.g. :9090.")
+var frontierFileFlag = flag.String("frontier-file", "",
+	"Keep the crawl queue in this file so an interrupted crawl can be resumed.")
+
+const (
+	SEED_URL = "http://www.kickstarter.com/discover/categories/technology?format=json&sort=end_date"
+)
 
 func main() {
 	flag.Parse()
 
-	spider := dspider.NewSimpleSpider(http.DefaultClient, *maxConcurrentCrawlsFlag,
-		&dspider.SimpleRetrier{
-			Times:    *maxCrawlRetriesFlag,
-			Interval: *crawlRetryIntervalFlag,
+	var frontier dspider.Frontier = dspider.NewMemFrontier()
+	if *coordinatorFlag != "" {
+		workerID := *workerIDFlag
+		if workerID == "" {
+			hostname, _ := os.Hostname()
+			workerID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+		}
+		remoteFrontier := dspider.NewRemoteFrontier(http.DefaultClient, *coordinatorFlag,
+			workerID, 10*time.Second)
+		defer remoteFrontier.Close()
+		frontier = remoteFrontier
+	} else if *frontierFileFlag != "" {
+		sqlFrontier, err := dspider.NewSqlFrontier(*sqlDriverFlag, *frontierFileFlag)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer sqlFrontier.Close()
+		if sqlFrontier.Len() == 0 && sqlFrontier.Seen(SEED_URL) {
+			glog.Infof("Nothing left to crawl in '%s'.", *frontierFileFlag)
+			return
+		}
+		frontier = sqlFrontier
+	}
+
+	spider := dspider.NewSimpleSpiderWithFrontier(http.DefaultClient, *maxConcurrentCrawlsFlag,
+		&dspider.BackoffRetrier{
+			InitialInterval: *crawlRetryIntervalFlag,
+			Jitter:          0.2,
+			MaxRetries:      *maxCrawlRetriesFlag,
+		}, frontier)
+	spider.SetDefaultPoliteness(dspider.Politeness{MinDelay: *crawlDelayFlag})
+	spider.SetMaxDepth(*maxDepthFlag)
+	if *autoThrottleFlag > 0 {
+		spider.SetAutoThrottle(dspider.AutoThrottle{
+			TargetConcurrency: *autoThrottleFlag,
+			MinDelay:          *crawlDelayFlag,
 		})
+	}
+	if *userAgentFlag != "" {
+		spider.SetRobotsUserAgent(*userAgentFlag)
+	}
+	if *ignoreRobotsFlag {
+		spider.DisableRobots()
+	}
+	if *deadLetterFileFlag != "" {
+		deadLetters, err := dspider.NewSqlDeadLetterStore(*sqlDriverFlag, *deadLetterFileFlag)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer deadLetters.Close()
+		spider.SetDeadLetterStore(deadLetters)
+	}
 	var parser JsonParser
 	spider.AddDocParser("^http://www[.]kickstarter[.]com/discover/categories/", &parser)
 	outputFile := *outputFileFlag
 	if outputFile == "" {
 		outputFile = fmt.Sprintf("kickstarter-%s.sqlite3", time.Now().Format("20060102"))
 	}
-	storage, err := dspider.NewSqlStorage(*sqlDriverFlag, outputFile, []dspider.SqlTableDef{
-		dspider.SqlTableDef{
-			Name: PROJECTS_TABLE_NAME,
-			Columns: map[string]string{
-				"id":            "INTEGER PRIMARY KEY",
-				"name":          "TEXT NOT NULL",
-				"desc":          "TEXT",
-				"goal":          "REAL NOT NULL",
-				"pledged":       "REAL NOT NULL",
-				"currency":      "TEXT NOT NULL",
-				"usd_rate":      "REAL NOT NULL",
-				"country":       "TEXT NOT NULL",
-				"backers_count": "INTEGER",
-				"created_at":    "TIMESTAMP NOT NULL",
-				"launched_at":   "TIMESTAMP NOT NULL",
-				"deadline":      "TIMESTAMP NOT NULL",
-				"category":      "TEXT",
-				"slug":          "TEXT",
-				"url":           "TEXT",
-			},
-		},
-	})
+	storage, err := dspider.NewSqlStorage(*sqlDriverFlag, outputFile, nil)
 	if err != nil {
 		glog.Fatal(err)
 	}
-	defer storage.Close()
+	if err := storage.RegisterStruct(dspider.SqlTableDef{
+		Name: PROJECTS_TABLE_NAME,
+		// Recrawls refresh how the projects did.
+		OnConflict: dspider.ConflictPolicy{
+			Action:        dspider.CONFLICT_UPDATE,
+			UpdateColumns: []string{"pledged", "usd_rate", "backers_count", "deadline"},
+		},
+	}, &SQLRow{}); err != nil {
+		glog.Fatal(err)
+	}
+	storage.SetBatching(*sqlBatchSizeFlag, 5*time.Second)
+	defer func() {
+		if err := storage.Close(); err != nil {
+			glog.Error(err)
+		}
+	}()
 	spider.AddStorage("^https://www[.]kickstarter[.]com/projects/", storage)
-	parser.wg.Add(1)
-	spider.Queue("http://www.kickstarter.com/discover/categories/technology?format=json&sort=end_date")
-	parser.wg.Wait()
-	spider.Shutdown()
+
+	if *metricsListenFlag != "" {
+		http.Handle("/metrics", spider.MetricsHandler())
+		go func() {
+			glog.Fatal(http.ListenAndServe(*metricsListenFlag, nil))
+		}()
+	}
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	spider.Start(context.Background())
+	spider.QueueRequest(dspider.NewRequest(SEED_URL).
+		SetMeta(META_CATEGORY, "technology").SetMeta(META_PAGE, "1"))
+	select {
+	case <-spider.Done():
+	case <-interrupted:
+		glog.Infof("Interrupted, shutting down ...")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeoutFlag)
+	defer cancel()
+	if err := spider.Shutdown(ctx); err != nil {
+		glog.Error(err)
+	}
 }
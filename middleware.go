@@ -0,0 +1,57 @@
+package dspider
+
+import (
+	"context"
+	"net/http"
+)
+
+// Middleware hooks into every fetch attempt and every doc added. Embed BaseMiddleware to only
+// implement some of the hooks. OnRequest hooks run in the order they were added, the others in
+// reverse order.
+type Middleware interface {
+	// OnRequest can change the request before it's fetched. The changes only apply to this
+	// attempt. Returning an error fails the attempt.
+	OnRequest(ctx context.Context, req *Request) error
+	// OnResponse can validate a response. Returning an error fails the attempt, which may
+	// then be retried.
+	OnResponse(ctx context.Context, req *Request, resp *http.Response) error
+	// OnError is called when an attempt fails, including by OnRequest or OnResponse.
+	OnError(ctx context.Context, req *Request, err error)
+	// OnItem can change a doc before it's stored, or drop it by returning nil.
+	OnItem(ctx context.Context, urlStr string, doc interface{}) (interface{}, error)
+}
+
+type BaseMiddleware struct{}
+
+func (BaseMiddleware) OnRequest(ctx context.Context, req *Request) error {
+	return nil
+}
+
+func (BaseMiddleware) OnResponse(ctx context.Context, req *Request, resp *http.Response) error {
+	return nil
+}
+
+func (BaseMiddleware) OnError(ctx context.Context, req *Request, err error) {}
+
+func (BaseMiddleware) OnItem(ctx context.Context, urlStr string, doc interface{}) (
+	interface{}, error) {
+	return doc, nil
+}
+
+// HeaderMiddleware sets headers on every request that doesn't have them yet.
+type HeaderMiddleware struct {
+	BaseMiddleware
+	Header http.Header
+}
+
+func (m *HeaderMiddleware) OnRequest(ctx context.Context, req *Request) error {
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	for name, values := range m.Header {
+		if _, ok := req.Header[name]; !ok {
+			req.Header[name] = values
+		}
+	}
+	return nil
+}
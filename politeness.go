@@ -0,0 +1,292 @@
+package dspider
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Politeness limits how hard a host, or the URLs matching a rule, are crawled. Zero values
+// mean no limit.
+type Politeness struct {
+	MaxConcurrency int
+	// MinDelay is the minimum time between the starts of two requests.
+	MinDelay time.Duration
+	// Rate is in requests per second, allowing bursts of up to Burst requests.
+	Rate  float64
+	Burst int
+}
+
+type limiter struct {
+	p Politeness
+	// crawlDelay comes from robots.txt and raises p.MinDelay.
+	crawlDelay time.Duration
+	// auto is set for host limiters if auto-throttling, and adjusts autoDelay and
+	// autoConcurrency, which further limit p.
+	auto            *AutoThrottle
+	autoDelay       time.Duration
+	autoConcurrency int
+	mu              sync.Mutex
+	cond            *sync.Cond
+	active          int
+	last            time.Time
+	tokens          float64
+	refilled        time.Time
+}
+
+func newLimiter(p Politeness) *limiter {
+	l := &limiter{p: p, tokens: float64(p.burst()), refilled: time.Now()}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (p Politeness) burst() int {
+	if p.Burst > 0 {
+		return p.Burst
+	}
+	return 1
+}
+
+func (l *limiter) acquire(ctx context.Context) error {
+	// Wake up waiters if ctx is done.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.mu.Lock()
+			l.cond.Broadcast()
+			l.mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		for l.full() && ctx.Err() == nil {
+			l.cond.Wait()
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		wait := l.delay(time.Now())
+		if wait <= 0 {
+			break
+		}
+		l.mu.Unlock()
+		err := sleep(ctx, wait)
+		l.mu.Lock()
+		if err != nil {
+			return err
+		}
+	}
+	l.active++
+	l.last = time.Now()
+	if l.p.Rate > 0 {
+		l.tokens--
+	}
+	return nil
+}
+
+func (l *limiter) full() bool {
+	max := l.maxConcurrency()
+	return max > 0 && l.active >= max
+}
+
+func (l *limiter) maxConcurrency() int {
+	max := l.p.MaxConcurrency
+	if l.auto != nil && (max == 0 || l.autoConcurrency < max) {
+		max = l.autoConcurrency
+	}
+	return max
+}
+
+// delay returns how long to wait before the next request may start.
+func (l *limiter) delay(now time.Time) time.Duration {
+	var wait time.Duration
+	minDelay := l.p.MinDelay
+	if l.crawlDelay > minDelay {
+		minDelay = l.crawlDelay
+	}
+	if l.autoDelay > minDelay {
+		minDelay = l.autoDelay
+	}
+	if minDelay > 0 && !l.last.IsZero() {
+		wait = l.last.Add(minDelay).Sub(now)
+	}
+	if l.p.Rate > 0 {
+		l.tokens += now.Sub(l.refilled).Seconds() * l.p.Rate
+		if max := float64(l.p.burst()); l.tokens > max {
+			l.tokens = max
+		}
+		l.refilled = now
+		if l.tokens < 1 {
+			if w := time.Duration((1 - l.tokens) / l.p.Rate * float64(time.Second)); w > wait {
+				wait = w
+			}
+		}
+	}
+	return wait
+}
+
+func (l *limiter) setCrawlDelay(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.crawlDelay = d
+}
+
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.cond.Signal()
+}
+
+type politenessSpec struct {
+	regex *regexp.Regexp
+	l     *limiter
+}
+
+type politenessManager struct {
+	mu       sync.Mutex
+	def      Politeness
+	hosts    map[string]Politeness
+	limiters map[string]*limiter
+	rules    []politenessSpec
+	auto     *AutoThrottle
+}
+
+func newPolitenessManager() *politenessManager {
+	return &politenessManager{
+		hosts:    make(map[string]Politeness),
+		limiters: make(map[string]*limiter),
+	}
+}
+
+func (m *politenessManager) setDefault(p Politeness) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.def = p
+	for host := range m.limiters {
+		if _, ok := m.hosts[host]; !ok {
+			delete(m.limiters, host)
+		}
+	}
+}
+
+func (m *politenessManager) setHost(host string, p Politeness) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hosts[host] = p
+	delete(m.limiters, host)
+}
+
+func (m *politenessManager) setAutoThrottle(a *AutoThrottle) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.auto = a
+	m.limiters = make(map[string]*limiter)
+}
+
+func (m *politenessManager) addRule(regex string, p Politeness) {
+	m.rules = append(m.rules, politenessSpec{
+		regex: regexp.MustCompile(regex),
+		l:     newLimiter(p),
+	})
+}
+
+func (m *politenessManager) setCrawlDelay(urlStr string, d time.Duration) {
+	if l := m.hostLimiter(urlStr); l != nil {
+		l.setCrawlDelay(d)
+	}
+}
+
+// acquire blocks until the URL may be fetched, first by its host's limits, then by the limits
+// of the first matching rule. Unless it fails, the returned function must be called once the
+// request is done.
+func (m *politenessManager) acquire(ctx context.Context, urlStr string) (
+	release func(), err error) {
+	var ls []*limiter
+	if l := m.hostLimiter(urlStr); l != nil {
+		ls = append(ls, l)
+	}
+	for _, spec := range m.rules {
+		if spec.regex.MatchString(urlStr) {
+			ls = append(ls, spec.l)
+			break
+		}
+	}
+	for i, l := range ls {
+		if err := l.acquire(ctx); err != nil {
+			for _, acquired := range ls[:i] {
+				acquired.release()
+			}
+			return nil, err
+		}
+	}
+	return func() {
+		for _, l := range ls {
+			l.release()
+		}
+	}, nil
+}
+
+func (m *politenessManager) hostLimiter(urlStr string) *limiter {
+	host := hostOf(urlStr)
+	if host == "" {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.limiters[host]
+	if l == nil {
+		p, ok := m.hosts[host]
+		if !ok {
+			p = m.def
+		}
+		l = newLimiter(p)
+		if m.auto != nil {
+			l.auto = m.auto
+			l.autoDelay = m.auto.startDelay()
+			l.autoConcurrency = m.auto.maxConcurrency()
+		}
+		m.limiters[host] = l
+	}
+	return l
+}
+
+// adjust feeds a fetch result to the auto-throttle of the URL's host.
+func (m *politenessManager) adjust(urlStr string, latency time.Duration, resp *http.Response) {
+	m.mu.Lock()
+	auto := m.auto
+	m.mu.Unlock()
+	if auto == nil {
+		return
+	}
+	if l := m.hostLimiter(urlStr); l != nil {
+		if resp == nil {
+			l.adjust(latency, 0, 0)
+		} else {
+			l.adjust(latency, resp.StatusCode, parseRetryAfter(resp.Header.Get("Retry-After")))
+		}
+	}
+}
+
+// throttleDelays returns the current auto-throttle delay of each host.
+func (m *politenessManager) throttleDelays() map[string]time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.auto == nil {
+		return nil
+	}
+	delays := make(map[string]time.Duration, len(m.limiters))
+	for host, l := range m.limiters {
+		l.mu.Lock()
+		delays[host] = l.autoDelay
+		l.mu.Unlock()
+	}
+	return delays
+}
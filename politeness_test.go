@@ -0,0 +1,61 @@
+package dspider
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readingParser reads the whole body, like most parsers do.
+type readingParser struct{}
+
+func (readingParser) Parse(ctx context.Context, req *Request, resp *http.Response,
+	spider Spider) error {
+	_, err := ioutil.ReadAll(resp.Body)
+	return err
+}
+
+func TestPolitenessMaxConcurrencyCoversBody(t *testing.T) {
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+		// The headers arrive first and the body only later.
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("body"))
+	}))
+	defer srv.Close()
+
+	s := NewSimpleSpider(http.DefaultClient, 4, &SimpleRetrier{})
+	s.DisableRobots()
+	s.SetDefaultPoliteness(Politeness{MaxConcurrency: 1})
+	s.AddDocParser(".", readingParser{})
+	for i := 0; i < 8; i++ {
+		s.Queue(srv.URL + "/" + strconv.Itoa(i))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if maxActive != 1 {
+		t.Errorf("the server saw %d concurrent requests, want 1", maxActive)
+	}
+}
@@ -0,0 +1,184 @@
+package dspider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	REMOTE_FRONTIER_POLL_INTERVAL = time.Second
+	// REMOTE_FRONTIER_CALL_TIMEOUT bounds each call to the coordinator.
+	REMOTE_FRONTIER_CALL_TIMEOUT = 10 * time.Second
+)
+
+// RemoteFrontier is the Frontier of a worker in a distributed crawl. It leases requests from a
+// Coordinator, and sends heartbeats so that its leases don't expire during long crawls.
+// Len is refreshed every poll interval instead of being asked for on every call.
+type RemoteFrontier struct {
+	client  *http.Client
+	baseURL string
+	worker  string
+	stop    chan struct{}
+
+	mu sync.Mutex
+	// length is the last Len of the coordinator, plus what was pushed since.
+	length int
+}
+
+func NewRemoteFrontier(client *http.Client, baseURL, worker string,
+	heartbeatInterval time.Duration) *RemoteFrontier {
+	f := &RemoteFrontier{
+		client:  client,
+		baseURL: baseURL,
+		worker:  worker,
+		stop:    make(chan struct{}),
+		// Don't let the spider believe the crawl is over before the first refresh.
+		length: 1,
+	}
+	go f.heartbeatLoop(heartbeatInterval)
+	go f.lenLoop()
+	return f
+}
+
+func (f *RemoteFrontier) Close() error {
+	close(f.stop)
+	return nil
+}
+
+// PollInterval tells SimpleSpider how often to check for requests pushed by other workers.
+func (f *RemoteFrontier) PollInterval() time.Duration {
+	return REMOTE_FRONTIER_POLL_INTERVAL
+}
+
+func (f *RemoteFrontier) Push(req *Request) bool {
+	var reply pushReply
+	if err := f.call(COORDINATOR_PATH_PUSH, req, &reply); err != nil {
+		glog.Errorf("Failed to queue '%s': %v", req.Key(), err)
+		return false
+	}
+	if reply.Queued {
+		f.mu.Lock()
+		f.length++
+		f.mu.Unlock()
+	}
+	return reply.Queued
+}
+
+func (f *RemoteFrontier) Pop() (*Request, bool) {
+	var req Request
+	if err := f.call(COORDINATOR_PATH_LEASE, nil, &req); err == errNoContent {
+		return nil, false
+	} else if err != nil {
+		glog.Errorf("Failed to lease a request: %v", err)
+		return nil, false
+	}
+	return &req, true
+}
+
+// Len is the length of the whole crawl, including what other workers are crawling, as of the
+// last refresh.
+func (f *RemoteFrontier) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.length
+}
+
+func (f *RemoteFrontier) refreshLen() {
+	var reply lenReply
+	err := f.call(COORDINATOR_PATH_LEN, nil, &reply)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err != nil {
+		glog.Errorf("Failed to get frontier length: %v", err)
+		// Don't let the spider believe the crawl is over.
+		if f.length == 0 {
+			f.length = 1
+		}
+		return
+	}
+	f.length = reply.Len
+}
+
+func (f *RemoteFrontier) lenLoop() {
+	f.refreshLen()
+	ticker := time.NewTicker(f.PollInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.refreshLen()
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+func (f *RemoteFrontier) MarkDone(req *Request) {
+	if err := f.call(COORDINATOR_PATH_DONE, req, nil); err != nil {
+		glog.Errorf("Failed to mark '%s' done: %v", req.Key(), err)
+	}
+}
+
+func (f *RemoteFrontier) Requeue(req *Request) bool {
+	if err := f.call(COORDINATOR_PATH_REQUEUE, req, nil); err != nil {
+		glog.Errorf("Failed to requeue '%s': %v", req.Key(), err)
+		return false
+	}
+	return true
+}
+
+func (f *RemoteFrontier) heartbeatLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.call(COORDINATOR_PATH_HEARTBEAT, nil, nil); err != nil {
+				glog.Warningf("Failed to send heartbeat: %v", err)
+			}
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+var errNoContent = fmt.Errorf("no content")
+
+func (f *RemoteFrontier) call(path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	urlStr := f.baseURL + path + "?" + url.Values{COORDINATOR_PARAM_WORKER: {f.worker}}.Encode()
+	ctx, cancel := context.WithTimeout(context.Background(), REMOTE_FRONTIER_CALL_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequest("POST", urlStr, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return errNoContent
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	case out != nil:
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package dspider
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// Request is what flows from Spider.QueueRequest to the Crawler and the DocParser.
+type Request struct {
+	// Method defaults to GET.
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+	// Requests with higher priority are crawled first.
+	Priority int
+	// Depth is 0 for seeds and one more than the parent's for requests made by Child.
+	Depth int
+	// Referrer is the URL of the parent request. It's sent as the Referer header.
+	Referrer string
+	// Meta is carried along with the request. Values are strings so that persistent frontiers
+	// can keep them.
+	Meta map[string]string
+	// Attempts counts the failed crawls of a request waiting to be retried, and FirstAttempt is
+	// when the first of them started.
+	Attempts     int
+	FirstAttempt time.Time
+	// NotBefore is when a request waiting to be retried can be popped from the frontier.
+	NotBefore time.Time
+}
+
+func NewRequest(urlStr string) *Request {
+	return &Request{Method: "GET", URL: urlStr}
+}
+
+// Child returns a GET request for a URL found while parsing r. It inherits r's priority and
+// a copy of r's metadata.
+func (r *Request) Child(urlStr string) *Request {
+	child := &Request{
+		Method:   "GET",
+		URL:      urlStr,
+		Priority: r.Priority,
+		Depth:    r.Depth + 1,
+		Referrer: r.URL,
+	}
+	if len(r.Meta) > 0 {
+		child.Meta = make(map[string]string, len(r.Meta))
+		for key, value := range r.Meta {
+			child.Meta[key] = value
+		}
+	}
+	return child
+}
+
+// clone copies r, including its header and metadata, but shares its body.
+func (r *Request) clone() *Request {
+	c := *r
+	if r.Header != nil {
+		c.Header = make(http.Header, len(r.Header))
+		for name, values := range r.Header {
+			c.Header[name] = append([]string(nil), values...)
+		}
+	}
+	if r.Meta != nil {
+		c.Meta = make(map[string]string, len(r.Meta))
+		for key, value := range r.Meta {
+			c.Meta[key] = value
+		}
+	}
+	return &c
+}
+
+// SetMeta sets a metadata value and returns r.
+func (r *Request) SetMeta(key, value string) *Request {
+	if r.Meta == nil {
+		r.Meta = make(map[string]string)
+	}
+	r.Meta[key] = value
+	return r
+}
+
+func (r *Request) method() string {
+	if r.Method == "" {
+		return "GET"
+	}
+	return r.Method
+}
+
+// Key identifies the request for de-duplication. It's the URL for GET requests without body.
+func (r *Request) Key() string {
+	method := r.method()
+	if method == "GET" && len(r.Body) == 0 {
+		return r.URL
+	}
+	key := method + " " + r.URL
+	if len(r.Body) > 0 {
+		sum := sha1.Sum(r.Body)
+		key += " " + hex.EncodeToString(sum[:])
+	}
+	return key
+}
+
+func (r *Request) HTTPRequest(ctx context.Context) (*http.Request, error) {
+	req, err := http.NewRequest(r.method(), r.URL, bytes.NewReader(r.Body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range r.Header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	if r.Referrer != "" && req.Header.Get("Referer") == "" {
+		req.Header.Set("Referer", r.Referrer)
+	}
+	return req.WithContext(ctx), nil
+}
+
+type requestKey struct{}
+
+// ContextRequest returns the request being parsed, from the context passed to DocParser.Parse.
+func ContextRequest(ctx context.Context) *Request {
+	req, _ := ctx.Value(requestKey{}).(*Request)
+	return req
+}
+
+func withRequest(ctx context.Context, req *Request) context.Context {
+	return context.WithValue(ctx, requestKey{}, req)
+}
+
+// RequestSetter is implemented by docs that want to know which request they were parsed from.
+// Spider.AddDoc calls SetRequest before storing them.
+type RequestSetter interface {
+	SetRequest(req *Request)
+}
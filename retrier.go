@@ -1,11 +1,133 @@
 package dspider
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
 	"time"
 )
 
+const (
+	DEFAULT_INITIAL_RETRY_INTERVAL = time.Second
+	DEFAULT_MAX_RETRY_INTERVAL     = time.Minute
+	DEFAULT_RETRY_MULTIPLIER       = 2
+)
+
+// DEFAULT_RETRY_STATUS_CODES are the status codes BackoffRetrier retries unless told otherwise.
+var DEFAULT_RETRY_STATUS_CODES = map[int]bool{
+	http.StatusRequestTimeout:      true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
 type Retrier interface {
-	RunWithRetry(job func() error) error
+	// RunWithRetry gives up and returns ctx.Err() once ctx is done.
+	RunWithRetry(ctx context.Context, job func() error) error
+}
+
+// Retriers that implement StatusRetrier get a *StatusError instead of a response with a status
+// code they want to retry. Otherwise any response is a success.
+type StatusRetrier interface {
+	Retrier
+	RetryStatus(statusCode int) bool
+}
+
+// StatusError is a response that failed because of its status code.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	// RetryAfter is from the Retry-After header, 0 if there was none.
+	RetryAfter time.Duration
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %s", e.Status)
+}
+
+// statusCodeOf returns the status code of a *StatusError, 0 for other errors.
+func statusCodeOf(err error) int {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+	return 0
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks an error, e.g. returned by a Middleware, as not worth retrying.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// Retryable is false for errors that would only happen again: ones marked Permanent, context
+// errors and TLS certificate or handshake failures.
+func Retryable(err error) bool {
+	var (
+		permanent   permanentError
+		recordErr   tls.RecordHeaderError
+		unknownErr  x509.UnknownAuthorityError
+		hostnameErr x509.HostnameError
+		invalidErr  x509.CertificateInvalidError
+	)
+	switch {
+	case errors.As(err, &permanent),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &recordErr),
+		errors.As(err, &unknownErr),
+		errors.As(err, &hostnameErr),
+		errors.As(err, &invalidErr):
+		return false
+	}
+	return true
+}
+
+// Retriers that implement DelayedRetrier don't wait between attempts in the crawl worker.
+// SimpleSpider makes one attempt at a time, and puts failed requests back in the frontier until
+// their retry is due, so the worker can crawl other requests meanwhile.
+type DelayedRetrier interface {
+	Retrier
+	// NextRetry returns how long to wait before retrying, or false to give up. retries counts the
+	// previous retries, and elapsed is the time since the first attempt started.
+	NextRetry(retries int, elapsed time.Duration, err error) (wait time.Duration, ok bool)
 }
 
 type SimpleRetrier struct {
@@ -13,12 +135,129 @@ type SimpleRetrier struct {
 	Interval time.Duration
 }
 
-func (r *SimpleRetrier) RunWithRetry(job func() error) (err error) {
+func (r *SimpleRetrier) RunWithRetry(ctx context.Context, job func() error) (err error) {
 	for i := 0; i <= r.Times; i++ {
-		if err = job(); err == nil {
+		if err = job(); err == nil || i == r.Times {
 			break
 		}
-		time.Sleep(r.Interval)
+		if err := sleep(ctx, r.Interval); err != nil {
+			return err
+		}
 	}
 	return
 }
+
+func (r *SimpleRetrier) NextRetry(retries int, elapsed time.Duration, err error) (
+	time.Duration, bool) {
+	return r.Interval, retries < r.Times
+}
+
+// BackoffRetrier waits exponentially longer between retries, or as long as a Retry-After header
+// asks if that's longer. Zero intervals and multiplier take their defaults; the zero value
+// retries nothing, since MaxRetries 0 means no retries.
+type BackoffRetrier struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	// Jitter randomizes each interval by up to this fraction of it, e.g. 0.2 for +-20%.
+	Jitter float64
+	// MaxElapsedTime stops retrying if the next attempt would start later than this after the
+	// first one. 0 means no limit.
+	MaxElapsedTime time.Duration
+	// MaxRetries is how many times to retry at most. 0 means no retries and negative means no
+	// limit.
+	MaxRetries int
+	// RetryStatusCodes defaults to DEFAULT_RETRY_STATUS_CODES.
+	RetryStatusCodes map[int]bool
+	// Classifier decides which errors to retry. By default *StatusErrors are retried by their
+	// RetryStatus, and other errors if they are Retryable.
+	Classifier func(err error) bool
+}
+
+func (r *BackoffRetrier) RetryStatus(statusCode int) bool {
+	if r.RetryStatusCodes == nil {
+		return DEFAULT_RETRY_STATUS_CODES[statusCode]
+	}
+	return r.RetryStatusCodes[statusCode]
+}
+
+func (r *BackoffRetrier) retryable(err error) bool {
+	if r.Classifier != nil {
+		return r.Classifier(err)
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return r.RetryStatus(statusErr.StatusCode)
+	}
+	return Retryable(err)
+}
+
+// interval returns the wait before the retry after the given number of them.
+func (r *BackoffRetrier) interval(retries int, err error) time.Duration {
+	initial, max, multiplier := r.InitialInterval, r.MaxInterval, r.Multiplier
+	if initial <= 0 {
+		initial = DEFAULT_INITIAL_RETRY_INTERVAL
+	}
+	if max <= 0 {
+		max = DEFAULT_MAX_RETRY_INTERVAL
+	}
+	if multiplier <= 0 {
+		multiplier = DEFAULT_RETRY_MULTIPLIER
+	}
+	d := float64(initial)
+	for i := 0; i < retries && d < float64(max); i++ {
+		d *= multiplier
+	}
+	if d > float64(max) {
+		d = float64(max)
+	}
+	d *= 1 + r.Jitter*(2*rand.Float64()-1)
+	wait := time.Duration(d)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > wait {
+		wait = statusErr.RetryAfter
+	}
+	return wait
+}
+
+func (r *BackoffRetrier) NextRetry(retries int, elapsed time.Duration, err error) (
+	time.Duration, bool) {
+	if !r.retryable(err) || (r.MaxRetries >= 0 && retries >= r.MaxRetries) {
+		return 0, false
+	}
+	wait := r.interval(retries, err)
+	if r.MaxElapsedTime > 0 && elapsed+wait > r.MaxElapsedTime {
+		return 0, false
+	}
+	return wait, true
+}
+
+func (r *BackoffRetrier) RunWithRetry(ctx context.Context, job func() error) error {
+	start := time.Now()
+	for retries := 0; ; retries++ {
+		err := job()
+		if err == nil {
+			return nil
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		wait, ok := r.NextRetry(retries, time.Since(start), err)
+		if !ok {
+			return err
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
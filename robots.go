@@ -0,0 +1,239 @@
+package dspider
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	DEFAULT_USER_AGENT = "dspider"
+
+	ROBOTS_CACHE_TTL       = 24 * time.Hour
+	ROBOTS_ERROR_CACHE_TTL = time.Minute
+	ROBOTS_MAX_SIZE        = 512 * 1024
+)
+
+type robotsRule struct {
+	allow  bool
+	length int
+	regex  *regexp.Regexp
+}
+
+type robotsRules struct {
+	rules      []robotsRule
+	crawlDelay time.Duration
+	// unreachable disallows everything until robots.txt is fetched again.
+	unreachable bool
+}
+
+var (
+	robotsAllowAll    = &robotsRules{}
+	robotsUnreachable = &robotsRules{unreachable: true}
+)
+
+// newRobotsRule compiles a path pattern, which may contain '*' and a trailing '$'.
+func newRobotsRule(allow bool, pattern string) robotsRule {
+	expr := pattern
+	anchored := strings.HasSuffix(expr, "$")
+	if anchored {
+		expr = expr[:len(expr)-1]
+	}
+	parts := strings.Split(expr, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	expr = "^" + strings.Join(parts, ".*")
+	if anchored {
+		expr += "$"
+	}
+	return robotsRule{allow: allow, length: len(pattern), regex: regexp.MustCompile(expr)}
+}
+
+type robotsGroup struct {
+	agents []string
+	rules  robotsRules
+}
+
+// parseRobots returns the rules of the group whose user-agent is the longest one contained in
+// userAgent, falling back to the '*' group.
+func parseRobots(r io.Reader, userAgent string) *robotsRules {
+	var groups []*robotsGroup
+	var group *robotsGroup
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+		switch key {
+		case "user-agent":
+			// Consecutive user-agent lines share one group.
+			if group == nil || len(group.rules.rules) > 0 || group.rules.crawlDelay > 0 {
+				group = &robotsGroup{}
+				groups = append(groups, group)
+			}
+			group.agents = append(group.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			if group != nil && value != "" {
+				group.rules.rules = append(group.rules.rules, newRobotsRule(key == "allow", value))
+			}
+		case "crawl-delay":
+			if secs, err := strconv.ParseFloat(value, 64); group != nil && err == nil && secs > 0 {
+				group.rules.crawlDelay = time.Duration(secs * float64(time.Second))
+			}
+		}
+	}
+
+	agent := strings.ToLower(userAgent)
+	if i := strings.IndexByte(agent, '/'); i >= 0 {
+		agent = agent[:i]
+	}
+	var best, wildcard *robotsRules
+	bestLen := 0
+	for _, g := range groups {
+		for _, ua := range g.agents {
+			if ua == "*" {
+				if wildcard == nil {
+					wildcard = &g.rules
+				}
+			} else if ua != "" && strings.Contains(agent, ua) && len(ua) > bestLen {
+				best, bestLen = &g.rules, len(ua)
+			}
+		}
+	}
+	if best != nil {
+		return best
+	} else if wildcard != nil {
+		return wildcard
+	}
+	return robotsAllowAll
+}
+
+// allowed applies the longest matching rule. Allow wins ties.
+func (r *robotsRules) allowed(path string) bool {
+	allow, matched := true, -1
+	for _, rule := range r.rules {
+		if rule.length < matched || !rule.regex.MatchString(path) {
+			continue
+		}
+		if rule.length > matched || rule.allow {
+			allow = rule.allow
+		}
+		matched = rule.length
+	}
+	return allow
+}
+
+type robotsEntry struct {
+	ready   chan struct{}
+	rules   *robotsRules
+	expires time.Time
+}
+
+type robotsCache struct {
+	client    *http.Client
+	userAgent string
+	mu        sync.Mutex
+	entries   map[string]*robotsEntry
+}
+
+func newRobotsCache(client *http.Client, userAgent string) *robotsCache {
+	return &robotsCache{
+		client:    client,
+		userAgent: userAgent,
+		entries:   make(map[string]*robotsEntry),
+	}
+}
+
+// check returns whether the URL may be crawled and the Crawl-delay of its host. If robots.txt
+// is unreachable, it returns false and when to fetch it again.
+func (c *robotsCache) check(ctx context.Context, urlStr string) (bool, time.Duration,
+	time.Time) {
+	urlObj, err := url.Parse(urlStr)
+	if err != nil || urlObj.Host == "" {
+		return true, 0, time.Time{}
+	}
+	rules, expires := c.rules(ctx, urlObj.Scheme+"://"+urlObj.Host)
+	if rules.unreachable {
+		return false, 0, expires
+	}
+	path := urlObj.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if urlObj.RawQuery != "" {
+		path += "?" + urlObj.RawQuery
+	}
+	return rules.allowed(path), rules.crawlDelay, time.Time{}
+}
+
+func (c *robotsCache) rules(ctx context.Context, site string) (*robotsRules, time.Time) {
+	c.mu.Lock()
+	entry := c.entries[site]
+	if entry != nil {
+		select {
+		case <-entry.ready:
+			if time.Now().After(entry.expires) {
+				entry = nil
+			}
+		default:
+		}
+	}
+	if entry == nil {
+		entry = &robotsEntry{ready: make(chan struct{})}
+		c.entries[site] = entry
+		c.mu.Unlock()
+		entry.rules, entry.expires = c.fetch(ctx, site)
+		if ctx.Err() != nil {
+			// Don't cache a failure caused by cancellation.
+			entry.expires = time.Time{}
+		}
+		close(entry.ready)
+		return entry.rules, entry.expires
+	}
+	c.mu.Unlock()
+	<-entry.ready
+	return entry.rules, entry.expires
+}
+
+// fetch follows RFC 9309: a missing robots.txt allows everything, an unreachable one
+// disallows everything until it's fetched again.
+func (c *robotsCache) fetch(ctx context.Context, site string) (*robotsRules, time.Time) {
+	req, err := http.NewRequest("GET", site+"/robots.txt", nil)
+	if err != nil {
+		return robotsAllowAll, time.Now().Add(ROBOTS_CACHE_TTL)
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		glog.V(0).Infof("Failed to fetch robots.txt of '%s': %v", site, err)
+		return robotsUnreachable, time.Now().Add(ROBOTS_ERROR_CACHE_TTL)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return parseRobots(io.LimitReader(resp.Body, ROBOTS_MAX_SIZE), c.userAgent),
+			time.Now().Add(ROBOTS_CACHE_TTL)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return robotsAllowAll, time.Now().Add(ROBOTS_CACHE_TTL)
+	default:
+		glog.V(0).Infof("Failed to fetch robots.txt of '%s': %s", site, resp.Status)
+		return robotsUnreachable, time.Now().Add(ROBOTS_ERROR_CACHE_TTL)
+	}
+}
@@ -0,0 +1,99 @@
+package dspider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testRobots = `# Comments are ignored.
+User-agent: other
+Disallow: /
+
+User-agent: dspider
+User-agent: spider
+Disallow: /private
+Allow: /private/public
+Disallow: /*.pdf$
+Disallow: /search*q=
+Crawl-delay: 2
+
+User-agent: *
+Disallow: /
+Allow: /$
+`
+
+func TestParseRobots(t *testing.T) {
+	for _, test := range []struct {
+		userAgent, path string
+		want            bool
+	}{
+		// The version is ignored, and the named group wins over *.
+		{"dspider/1.0", "/", true},
+		{"dspider/1.0", "/private", false},
+		{"dspider/1.0", "/private/x", false},
+		{"dspider/1.0", "/private/public/x", true},
+		{"dspider/1.0", "/a.pdf", false},
+		{"dspider/1.0", "/a.pdf?x", true},
+		{"dspider/1.0", "/search?q=x", false},
+		{"dspider/1.0", "/search/x?p=1&q=x", false},
+		{"dspider/1.0", "/search?p=1", true},
+		// The group of consecutive user-agent lines is shared.
+		{"MySpider", "/private", false},
+		{"MySpider", "/other", true},
+		{"Other", "/", false},
+		{"unknown", "/", true},
+		{"unknown", "/x", false},
+	} {
+		rules := parseRobots(strings.NewReader(testRobots), test.userAgent)
+		if got := rules.allowed(test.path); got != test.want {
+			t.Errorf("%s %s: got %v, want %v", test.userAgent, test.path, got, test.want)
+		}
+	}
+	if d := parseRobots(strings.NewReader(testRobots), "dspider").crawlDelay; d != 2*time.Second {
+		t.Errorf("Crawl-delay is %v, want 2s", d)
+	}
+	if rules := parseRobots(strings.NewReader(""), "dspider"); !rules.allowed("/x") {
+		t.Error("an empty robots.txt disallows")
+	}
+}
+
+func TestRobotsTieAllows(t *testing.T) {
+	rules := parseRobots(strings.NewReader("User-agent: *\nDisallow: /a\nAllow: /a\n"), "dspider")
+	if !rules.allowed("/a") {
+		t.Error("Disallow won a tie with Allow")
+	}
+}
+
+func TestSpiderSendsRobotsUserAgent(t *testing.T) {
+	var mu sync.Mutex
+	agents := make(map[string]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		agents[r.URL.Path] = r.UserAgent()
+		mu.Unlock()
+		if r.URL.Path == "/robots.txt" {
+			w.Write([]byte("User-agent: *\nDisallow:\n"))
+		}
+	}))
+	defer srv.Close()
+
+	s := NewSimpleSpider(http.DefaultClient, 1, &SimpleRetrier{})
+	s.SetRobotsUserAgent("testbot/1.0")
+	s.AddDocParser(".", readingParser{})
+	s.Queue(srv.URL + "/page")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/robots.txt", "/page"} {
+		if agents[path] != "testbot/1.0" {
+			t.Errorf("%s was fetched as '%s'", path, agents[path])
+		}
+	}
+}
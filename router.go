@@ -0,0 +1,178 @@
+package dspider
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Rule routes the requests and docs it matches to its DocParsers, Storages and Crawler. The
+// patterns are regexes, and empty ones match everything. ContentType matches the Content-Type
+// header of the response, and isn't checked before there is one.
+//
+// The Parsers of all the matching rules parse the response, and their Storages all store the
+// docs, by Priority and then in the order the rules were added. A Final rule stops lower ones
+// from adding theirs. The Crawler is the one of the first matching rule that has one. Failed
+// crawls only go to the Parsers of rules without a ContentType.
+type Rule struct {
+	// Name is used in stats, and defaults to the patterns.
+	Name        string
+	URL         string
+	Host        string
+	Path        string
+	Query       string
+	Method      string
+	ContentType string
+	Priority    int
+	Final       bool
+	Parsers     []DocParser
+	Storages    []Storage
+	Crawler     Crawler
+}
+
+type route struct {
+	Rule
+	url, host, path, query, method, contentType *regexp.Regexp
+}
+
+func compilePattern(pattern string) *regexp.Regexp {
+	if pattern == "" {
+		return nil
+	}
+	return regexp.MustCompile(pattern)
+}
+
+func newRoute(r Rule) *route {
+	if r.Name == "" {
+		var patterns []string
+		for _, p := range []struct{ name, pattern string }{
+			{"host", r.Host}, {"path", r.Path}, {"query", r.Query}, {"method", r.Method},
+			{"content-type", r.ContentType},
+		} {
+			if p.pattern != "" {
+				patterns = append(patterns, p.name+"="+p.pattern)
+			}
+		}
+		if r.URL != "" {
+			patterns = append([]string{r.URL}, patterns...)
+		}
+		r.Name = strings.Join(patterns, ",")
+	}
+	return &route{
+		Rule:        r,
+		url:         compilePattern(r.URL),
+		host:        compilePattern(r.Host),
+		path:        compilePattern(r.Path),
+		query:       compilePattern(r.Query),
+		method:      compilePattern(r.Method),
+		contentType: compilePattern(r.ContentType),
+	}
+}
+
+// match treats an empty method or contentType as unknown, which matches.
+func (r *route) match(urlStr, method, contentType string) bool {
+	matches := func(re *regexp.Regexp, s string) bool {
+		return re == nil || re.MatchString(s)
+	}
+	if !matches(r.url, urlStr) {
+		return false
+	}
+	if r.host != nil || r.path != nil || r.query != nil {
+		urlObj, err := url.Parse(urlStr)
+		if err != nil || !matches(r.host, urlObj.Host) || !matches(r.path, urlObj.Path) ||
+			!matches(r.query, urlObj.RawQuery) {
+			return false
+		}
+	}
+	return (method == "" || matches(r.method, method)) &&
+		(contentType == "" || matches(r.contentType, contentType))
+}
+
+type router struct {
+	routes   []*route
+	fallback Storage
+}
+
+func (rt *router) add(r Rule) {
+	rt.routes = append(rt.routes, newRoute(r))
+	sort.SliceStable(rt.routes, func(i, j int) bool {
+		return rt.routes[i].Priority > rt.routes[j].Priority
+	})
+}
+
+// find returns the matching routes that have what has() looks for, up to the first Final one.
+func (rt *router) find(urlStr, method, contentType string, has func(r *route) bool) []*route {
+	var routes []*route
+	for _, r := range rt.routes {
+		if has(r) && r.match(urlStr, method, contentType) {
+			routes = append(routes, r)
+			if r.Final {
+				break
+			}
+		}
+	}
+	return routes
+}
+
+// parsers also returns the name of the first matching rule, which stats are kept under.
+func (rt *router) parsers(urlStr, method, contentType string) (string, []DocParser) {
+	var name string
+	var parsers []DocParser
+	for i, r := range rt.find(urlStr, method, contentType, func(r *route) bool {
+		return len(r.Parsers) > 0
+	}) {
+		if i == 0 {
+			name = r.Name
+		}
+		parsers = append(parsers, r.Parsers...)
+	}
+	return name, parsers
+}
+
+// failureParsers are told about failed crawls. There is no Content-Type then, so the parsers
+// of rules that restrict it are left out.
+func (rt *router) failureParsers(urlStr, method string) []DocParser {
+	var parsers []DocParser
+	for _, r := range rt.find(urlStr, method, "", func(r *route) bool {
+		return len(r.Parsers) > 0 && r.contentType == nil
+	}) {
+		parsers = append(parsers, r.Parsers...)
+	}
+	return parsers
+}
+
+func (rt *router) storages(urlStr, method, contentType string) (string, []Storage) {
+	var name string
+	var storages []Storage
+	for i, r := range rt.find(urlStr, method, contentType, func(r *route) bool {
+		return len(r.Storages) > 0
+	}) {
+		if i == 0 {
+			name = r.Name
+		}
+		storages = append(storages, r.Storages...)
+	}
+	return name, storages
+}
+
+func (rt *router) crawler(req *Request) Crawler {
+	for _, r := range rt.routes {
+		if r.Crawler != nil && r.match(req.URL, req.method(), "") {
+			return r.Crawler
+		}
+	}
+	return defaultCrawler{}
+}
+
+type contentTypeKey struct{}
+
+func withContentType(ctx context.Context, contentType string) context.Context {
+	return context.WithValue(ctx, contentTypeKey{}, contentType)
+}
+
+func contextContentType(ctx context.Context) string {
+	contentType, _ := ctx.Value(contentTypeKey{}).(string)
+	return contentType
+}
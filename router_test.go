@@ -0,0 +1,69 @@
+package dspider
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+type namedParser string
+
+func (namedParser) Parse(ctx context.Context, req *Request, resp *http.Response,
+	spider Spider) error {
+	return nil
+}
+
+func TestRouterCombinesRules(t *testing.T) {
+	var rt router
+	rt.add(Rule{URL: "^http://a/", Parsers: []DocParser{namedParser("url")}})
+	rt.add(Rule{Host: "^a$", Parsers: []DocParser{namedParser("host")}})
+	rt.add(Rule{ContentType: "json", Priority: 1, Parsers: []DocParser{namedParser("json")}})
+	rt.add(Rule{Path: "^/final", Priority: 2, Final: true,
+		Parsers: []DocParser{namedParser("final")}})
+	for _, test := range []struct {
+		url, contentType string
+		wantName         string
+		want             []DocParser
+	}{
+		{"http://a/x", "", "content-type=json", []DocParser{namedParser("json"), namedParser("url"),
+			namedParser("host")}},
+		{"http://a/x", "text/html", "^http://a/", []DocParser{namedParser("url"),
+			namedParser("host")}},
+		{"http://b/x", "text/json", "content-type=json", []DocParser{namedParser("json")}},
+		{"http://a/final", "text/json", "path=^/final", []DocParser{namedParser("final")}},
+		{"http://b/x", "text/html", "", nil},
+	} {
+		name, parsers := rt.parsers(test.url, "GET", test.contentType)
+		if name != test.wantName || len(parsers) != len(test.want) {
+			t.Errorf("%s %s: got %s %v, want %s %v", test.url, test.contentType, name, parsers,
+				test.wantName, test.want)
+			continue
+		}
+		for i := range parsers {
+			if parsers[i] != test.want[i] {
+				t.Errorf("%s %s: got %v, want %v", test.url, test.contentType, parsers,
+					test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestRouterFailureParsers(t *testing.T) {
+	var rt router
+	rt.add(Rule{ContentType: "json", Parsers: []DocParser{namedParser("json")}})
+	rt.add(Rule{URL: "^http://a/", Final: true, Parsers: []DocParser{namedParser("a")}})
+	rt.add(Rule{Parsers: []DocParser{namedParser("all")}})
+	for _, test := range []struct {
+		url  string
+		want []DocParser
+	}{
+		{"http://a/x", []DocParser{namedParser("a")}},
+		{"http://b/x", []DocParser{namedParser("all")}},
+	} {
+		parsers := rt.failureParsers(test.url, "GET")
+		if len(parsers) != len(test.want) || parsers[0] != test.want[0] {
+			t.Errorf("%s: got %v, want %v", test.url, parsers, test.want)
+		}
+	}
+}
@@ -1,138 +1,767 @@
 package dspider
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
-	"regexp"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 )
 
+const (
+	// How often idle workers look for requests whose retry is due.
+	DELAYED_POLL_INTERVAL = 100 * time.Millisecond
+)
+
 type Spider interface {
+	// Queue queues a GET request.
 	Queue(urlStr string)
-	Shutdown()
+	QueueRequest(req *Request)
+	// Wait blocks until nothing is queued or being crawled, or the spider is shut down.
+	Wait()
+	// Done returns a channel that's closed when Wait would return.
+	Done() <-chan struct{}
+	Shutdown(ctx context.Context) error
 	// For DocParser. Users should not call this method.
-	AddDoc(urlStr string, doc interface{}) error
+	AddDoc(ctx context.Context, urlStr string, doc interface{}) error
 }
 
-type docParserSpec struct {
-	regex *regexp.Regexp
-	dp    DocParser
+// ShutdownError lists the keys of the requests that were still being crawled when Shutdown gave up on them.
+type ShutdownError struct {
+	Err       error
+	Abandoned []string
 }
 
-type storageSpec struct {
-	regex *regexp.Regexp
-	s     Storage
-}
-
-type crawlerSpec struct {
-	regex *regexp.Regexp
-	c     Crawler
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("%v, abandoned %d crawls: %s", e.Err, len(e.Abandoned),
+		strings.Join(e.Abandoned, ", "))
 }
 
 type SimpleSpider struct {
 	client   *http.Client
-	parsers  []docParserSpec
-	storages []storageSpec
-	crawlers []crawlerSpec
-	queue    chan string
+	router   router
 	retrier  Retrier
-	wg       sync.WaitGroup
+	polite   *politenessManager
+	robots   *robotsCache
+	blocked  func(req *Request)
+	stats    *statsCollector
+	breakers *breakerManager
+	dead     DeadLetterStore
+	mws      []Middleware
+
+	maxCrawls int
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+
+	// mu isn't held while calling the frontier, as a RemoteFrontier's calls are slow.
+	mu       sync.Mutex
+	cond     *sync.Cond
+	idle     *sync.Cond
+	space    *sync.Cond
+	frontier Frontier
+	inFlight map[string]int
+	// popping counts the workers in frontier.Pop, whose requests aren't in inFlight yet.
+	popping int
+	// pushes counts the pushes, so workers that found nothing to pop see what was pushed since.
+	pushes  uint64
+	closed  bool
+	aborted error
+	wake    *time.Timer
+
+	maxQueued int
+	maxDepth  int
+	userAgent string
+}
+
+// parserSpider is what DocParsers see. Its Queue never blocks, as the parser runs on a crawl
+// worker and waiting for the queue to shrink could deadlock.
+type parserSpider struct {
+	*SimpleSpider
+}
+
+func (ps parserSpider) Queue(urlStr string) {
+	ps.push(NewRequest(urlStr), false)
+}
+
+func (ps parserSpider) QueueRequest(req *Request) {
+	ps.push(req, false)
 }
 
 func NewSimpleSpider(client *http.Client, maxCrawls int, retrier Retrier) *SimpleSpider {
+	return NewSimpleSpiderWithFrontier(client, maxCrawls, retrier, NewMemFrontier())
+}
+
+func NewSimpleSpiderWithFrontier(client *http.Client, maxCrawls int, retrier Retrier,
+	frontier Frontier) *SimpleSpider {
 	s := &SimpleSpider{
-		client:  client,
-		queue:   make(chan string),
-		retrier: retrier,
-	}
-	s.wg.Add(maxCrawls)
-	for i := 0; i < maxCrawls; i++ {
-		go s.crawlLoop()
+		client:    client,
+		retrier:   retrier,
+		frontier:  frontier,
+		polite:    newPolitenessManager(),
+		robots:    newRobotsCache(client, DEFAULT_USER_AGENT),
+		userAgent: DEFAULT_USER_AGENT,
+		stats:     newStatsCollector(),
+		maxCrawls: maxCrawls,
+		inFlight:  make(map[string]int),
 	}
+	s.cond = sync.NewCond(&s.mu)
+	s.idle = sync.NewCond(&s.mu)
+	s.space = sync.NewCond(&s.mu)
 	return s
 }
 
+// Start starts crawling in the background, after all the parsers, storages and crawlers are
+// added. Cancelling ctx cancels all the in-flight crawls.
+func (s *SimpleSpider) Start(ctx context.Context) {
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.wg.Add(s.maxCrawls)
+	for i := 0; i < s.maxCrawls; i++ {
+		go s.crawlLoop(ctx)
+	}
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}()
+	if polled, ok := s.frontier.(polledFrontier); ok {
+		go s.pollLoop(ctx, polled.PollInterval())
+	}
+}
+
+func (s *SimpleSpider) pollLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.idle.Broadcast()
+			s.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Run crawls until there's nothing left to crawl or ctx is done, then shuts down. It returns
+// once all the crawls have, including those cancelled with ctx.
+func (s *SimpleSpider) Run(ctx context.Context) error {
+	s.Start(ctx)
+	select {
+	case <-s.Done():
+	case <-ctx.Done():
+	}
+	// The crawls run with ctx, so cancelled ones are already unwinding.
+	s.Shutdown(context.Background())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aborted != nil {
+		return s.aborted
+	}
+	return ctx.Err()
+}
+
+// AddRule routes what the rule matches to its parsers, storages and crawler, see Rule.
+func (s *SimpleSpider) AddRule(r Rule) {
+	s.router.add(r)
+}
+
+// AddDocParser adds a Final rule, so of the parsers added with it only the first whose regex
+// matches parses a response.
 func (s *SimpleSpider) AddDocParser(regex string, dp DocParser) {
-	s.parsers = append(s.parsers, docParserSpec{
-		regex: regexp.MustCompile(regex),
-		dp:    dp,
-	})
+	s.AddRule(Rule{URL: regex, Final: true, Parsers: []DocParser{dp}})
 }
 
+// AddStorage adds a Final rule like AddDocParser.
 func (s *SimpleSpider) AddStorage(regex string, storage Storage) {
-	s.storages = append(s.storages, storageSpec{
-		regex: regexp.MustCompile(regex),
-		s:     storage,
-	})
+	s.AddRule(Rule{URL: regex, Final: true, Storages: []Storage{storage}})
 }
 
 func (s *SimpleSpider) AddCrawler(regex string, c Crawler) {
-	s.crawlers = append(s.crawlers, crawlerSpec{
-		regex: regexp.MustCompile(regex),
-		c:     c,
-	})
+	s.AddRule(Rule{URL: regex, Crawler: c})
+}
+
+// SetDefaultStorage stores the docs that no rule has storages for. Without it, AddDoc fails
+// for them.
+func (s *SimpleSpider) SetDefaultStorage(storage Storage) {
+	s.router.fallback = storage
+}
+
+// Use adds a middleware. It must be called before Start.
+func (s *SimpleSpider) Use(m Middleware) {
+	s.mws = append(s.mws, m)
+}
+
+// SetAutoThrottle adapts each host's delay and concurrency to its load, see AutoThrottle. It
+// must be called before Start.
+func (s *SimpleSpider) SetAutoThrottle(a AutoThrottle) {
+	s.polite.setAutoThrottle(&a)
+}
+
+// SetDeadLetterStore keeps the requests that failed to crawl after all retries, or to parse.
+func (s *SimpleSpider) SetDeadLetterStore(store DeadLetterStore) {
+	s.dead = store
+}
+
+// SetCircuitBreaker stops crawling hosts that keep failing for a while, see Breaker. It must be
+// called before Start.
+func (s *SimpleSpider) SetCircuitBreaker(b Breaker) {
+	s.breakers = newBreakerManager(b)
+}
+
+// SetDefaultPoliteness sets the limits for every host without its own SetHostPoliteness.
+func (s *SimpleSpider) SetDefaultPoliteness(p Politeness) {
+	s.polite.setDefault(p)
+}
+
+// SetHostPoliteness sets the limits for a host, as in url.URL.Host.
+func (s *SimpleSpider) SetHostPoliteness(host string, p Politeness) {
+	s.polite.setHost(host, p)
+}
+
+// AddPoliteness adds limits shared by all URLs matching regex, on top of their host's limits.
+func (s *SimpleSpider) AddPoliteness(regex string, p Politeness) {
+	s.polite.addRule(regex, p)
+}
+
+// SetRobotsUserAgent sets the user-agent whose robots.txt rules are obeyed, which is also the
+// User-Agent header of requests that have none. It's DEFAULT_USER_AGENT unless changed. It
+// doesn't enable robots.txt after DisableRobots.
+func (s *SimpleSpider) SetRobotsUserAgent(userAgent string) {
+	s.userAgent = userAgent
+	if s.robots != nil {
+		s.robots = newRobotsCache(s.client, userAgent)
+	}
+}
+
+// DisableRobots stops checking robots.txt, e.g. for internal APIs.
+func (s *SimpleSpider) DisableRobots() {
+	s.robots = nil
+}
+
+// SetBlockedHandler sets the function called with every request robots.txt doesn't allow us
+// to crawl. Blocked requests are only logged by default.
+func (s *SimpleSpider) SetBlockedHandler(h func(req *Request)) {
+	s.blocked = h
+}
+
+// SetMaxQueued bounds the frontier for callers outside the spider: Queue blocks while n or
+// more URLs are waiting. URLs queued from DocParser.Parse are always accepted, so the frontier
+// can exceed n by what parsers discover. Zero means unbounded, which is the default.
+func (s *SimpleSpider) SetMaxQueued(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxQueued = n
+	s.space.Broadcast()
+}
+
+// SetMaxDepth drops requests deeper than n, see Request.Depth. Zero means no limit.
+func (s *SimpleSpider) SetMaxDepth(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxDepth = n
 }
 
+// Queue is safe to call from any goroutine. It only blocks if SetMaxQueued was called.
 func (s *SimpleSpider) Queue(urlStr string) {
-	s.queue <- urlStr
+	s.push(NewRequest(urlStr), true)
+}
+
+func (s *SimpleSpider) QueueRequest(req *Request) {
+	s.push(req, true)
+}
+
+func (s *SimpleSpider) push(req *Request, block bool) {
+	s.mu.Lock()
+	if s.maxDepth > 0 && req.Depth > s.maxDepth {
+		s.mu.Unlock()
+		glog.V(2).Infof("Dropped '%s', deeper than %d.", req.Key(), s.maxDepth)
+		return
+	}
+	for block && !s.closed && s.maxQueued > 0 && s.frontier.Len() >= s.maxQueued {
+		s.space.Wait()
+	}
+	s.mu.Unlock()
+	if !s.frontier.Push(req) {
+		glog.V(2).Infof("Dropped '%s', already queued.", req.Key())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pushes++
+	s.cond.Signal()
+}
+
+func (s *SimpleSpider) Wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.closed && !s.isIdle() {
+		s.idle.Wait()
+	}
+}
+
+// isIdle returns whether nothing is queued or being crawled. s.mu must be held.
+func (s *SimpleSpider) isIdle() bool {
+	return len(s.inFlight) == 0 && s.popping == 0 && s.frontier.Len() == 0
+}
+
+func (s *SimpleSpider) Done() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// Shutdown lets in-flight crawls finish until ctx is done, then cancels and abandons them,
+// returning a *ShutdownError. URLs still in the frontier are not crawled, and abandoned ones
+// are not marked done.
+func (s *SimpleSpider) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.idle.Broadcast()
+	s.space.Broadcast()
+	s.mu.Unlock()
+	if s.cancel == nil {
+		return nil
+	}
+	defer s.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	select {
+	case <-done:
+		return nil
+	default:
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := &ShutdownError{Err: ctx.Err()}
+	for key := range s.inFlight {
+		err.Abandoned = append(err.Abandoned, key)
+	}
+	return err
+}
+
+func (s *SimpleSpider) Stats() Stats {
+	var breakers map[string]int
+	if s.breakers != nil {
+		breakers = s.breakers.states()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Stats{
+		Queued:   s.frontier.Len(),
+		InFlight: len(s.inFlight),
+		ByKey:    s.stats.snapshot(),
+		Breakers: breakers,
+		Throttle: s.polite.throttleDelays(),
+	}
 }
 
-func (s *SimpleSpider) Shutdown() {
-	close(s.queue)
-	s.wg.Wait()
+// MetricsHandler serves Stats in the Prometheus text format, e.g. at /metrics.
+func (s *SimpleSpider) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := s.Stats()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		stats.WritePrometheus(w)
+	})
 }
 
-func (s *SimpleSpider) AddDoc(urlStr string, doc interface{}) error {
-	for _, spec := range s.storages {
-		if spec.regex.MatchString(urlStr) {
-			return spec.s.AddDoc(doc)
+func (s *SimpleSpider) AddDoc(ctx context.Context, urlStr string, doc interface{}) error {
+	for i := len(s.mws) - 1; i >= 0; i-- {
+		var err error
+		if doc, err = s.mws[i].OnItem(ctx, urlStr, doc); err != nil {
+			return err
+		} else if doc == nil {
+			return nil
+		}
+	}
+	if setter, ok := doc.(RequestSetter); ok {
+		if req := ContextRequest(ctx); req != nil {
+			setter.SetRequest(req)
+		}
+	}
+	var method string
+	if req := ContextRequest(ctx); req != nil {
+		method = req.method()
+	}
+	name, storages := s.router.storages(urlStr, method, contextContentType(ctx))
+	if len(storages) == 0 {
+		if s.router.fallback == nil {
+			return fmt.Errorf("no storage specified for '%s'", urlStr)
 		}
+		storages, name = []Storage{s.router.fallback}, "default"
 	}
-	return fmt.Errorf("no storage specified for '%s'", urlStr)
+	var firstErr error
+	for _, storage := range storages {
+		if err := storage.AddDoc(ctx, doc); err != nil {
+			s.stats.update(StatsKey{Host: hostOf(urlStr), Rule: name},
+				func(cs *CrawlStats) { cs.StorageErrors++ })
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
 }
 
-func (s *SimpleSpider) crawlLoop() {
+func (s *SimpleSpider) crawlLoop(ctx context.Context) {
 	defer s.wg.Done()
-	for urlStr := range s.queue {
-		if dp := s.docParser(urlStr); dp != nil {
-			glog.V(1).Infof("Crawling '%s' ...", urlStr)
-			if resp, err := s.crawl(urlStr); err == nil {
-				if err = dp.Parse(urlStr, resp, s); err != nil {
-					glog.V(0).Infof("Failed to parse '%s': %v", urlStr, err)
+	for {
+		req, ok := s.next(ctx)
+		if !ok {
+			return
+		}
+		rule, parsers := s.router.parsers(req.URL, req.method(), "")
+		allowed, parked := len(parsers) > 0, false
+		if allowed {
+			allowed, parked = s.allowedByRobots(ctx, req)
+		}
+		if parked {
+			s.finish(req)
+			continue
+		}
+		if allowed {
+			glog.V(1).Infof("Crawling '%s' ...", req.Key())
+			statsKey := StatsKey{Host: hostOf(req.URL), Rule: rule}
+			parseCtx := withRequest(ctx, req)
+			var token breakerToken
+			if s.breakers != nil {
+				var ok bool
+				var until time.Time
+				if token, ok, until = s.breakers.allow(statsKey.Host, time.Now()); !ok {
+					s.park(req, until, "circuit breaker open")
+					s.finish(req)
+					continue
 				}
+			}
+			start := time.Now()
+			resp, attempts, err := s.crawl(ctx, req, statsKey)
+			if s.breakers != nil {
+				s.breakers.done(statsKey.Host, token, err, time.Now())
+			}
+			if err == nil {
+				s.parse(parseCtx, req, resp, req.Attempts+attempts, statsKey)
 				resp.Body.Close()
-			} else {
-				glog.V(0).Infof("Failed to crawl '%s': %v", urlStr, err)
-				dp.Parse(urlStr, nil, s)
+			} else if ctx.Err() == nil && s.retryLater(req, err, start, statsKey) {
+				s.finish(req)
+				continue
+			} else if ctx.Err() == nil {
+				glog.V(0).Infof("Failed to crawl '%s': %v", req.Key(), err)
+				if !s.handleFailure(parseCtx, s.router.failureParsers(req.URL, req.method()),
+					req, req.Attempts+attempts, err) {
+					s.finish(req)
+					continue
+				}
 			}
 		}
+		// Leave cancelled crawls in flight, so a persistent frontier retries them next time.
+		if ctx.Err() == nil {
+			s.frontier.MarkDone(req)
+		}
+		s.finish(req)
 	}
 }
 
-func (s *SimpleSpider) docParser(urlStr string) DocParser {
-	for _, spec := range s.parsers {
-		if spec.regex.MatchString(urlStr) {
-			return spec.dp
+func (s *SimpleSpider) next(ctx context.Context) (*Request, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.closed && ctx.Err() == nil {
+		pushes := s.pushes
+		s.popping++
+		s.mu.Unlock()
+		req, ok := s.frontier.Pop()
+		s.mu.Lock()
+		s.popping--
+		if ok {
+			s.inFlight[req.Key()]++
+			s.space.Signal()
+			return req, true
+		} else if s.isIdle() {
+			s.idle.Broadcast()
+		}
+		if s.pushes != pushes {
+			continue
+		}
+		if _, polled := s.frontier.(polledFrontier); !polled && s.wake == nil &&
+			s.frontier.Len() > 0 {
+			// What's left waits to be retried.
+			s.wake = time.AfterFunc(DELAYED_POLL_INTERVAL, func() {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				s.wake = nil
+				s.cond.Broadcast()
+			})
 		}
+		s.cond.Wait()
 	}
-	return nil
+	return nil, false
 }
 
-func (s *SimpleSpider) crawl(urlStr string) (resp *http.Response, err error) {
-	crawler := s.client.Get
-	for _, spec := range s.crawlers {
-		if spec.regex.MatchString(urlStr) {
-			crawler = func(urlStr string) (*http.Response, error) {
-				return spec.c.Crawl(s.client, urlStr)
-			}
-			break
+// handleFailure tells the DocParsers about a failed crawl. The strongest of their actions wins,
+// FAILURE_ABORT over FAILURE_REQUEUE over FAILURE_SKIP. It returns false if the request was
+// requeued.
+func (s *SimpleSpider) handleFailure(ctx context.Context, dps []DocParser, req *Request,
+	attempts int, err error) bool {
+	dl := newDeadLetter(req, DEAD_LETTER_FETCH, attempts, err, 0)
+	action := FAILURE_SKIP
+	for _, dp := range dps {
+		h, ok := dp.(FailureHandler)
+		if !ok {
+			dp.Parse(ctx, req, nil, parserSpider{s})
+			continue
+		}
+		if a := h.HandleFailure(ctx, req, &Failure{
+			Err:        err,
+			Attempts:   attempts,
+			StatusCode: dl.StatusCode,
+		}, parserSpider{s}); a > action {
+			action = a
+		}
+	}
+	switch action {
+	case FAILURE_REQUEUE:
+		glog.V(1).Infof("Requeuing '%s' after %d attempts.", req.Key(), attempts)
+		req.Attempts = attempts
+		s.frontier.Requeue(req)
+		return false
+	case FAILURE_ABORT:
+		s.addDeadLetter(ctx, dl)
+		s.abort(fmt.Errorf("aborted after failing to crawl '%s': %v", req.Key(), err))
+	default:
+		s.addDeadLetter(ctx, dl)
+	}
+	return true
+}
+
+// abort stops crawling new requests, and makes Run return err.
+func (s *SimpleSpider) abort(err error) {
+	glog.Errorf("%v", err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aborted == nil {
+		s.aborted = err
+	}
+	s.closed = true
+	s.cond.Broadcast()
+	s.idle.Broadcast()
+	s.space.Broadcast()
+}
+
+func (s *SimpleSpider) addDeadLetter(ctx context.Context, dl *DeadLetter) {
+	if s.dead == nil {
+		return
+	}
+	if err := s.dead.AddDeadLetter(ctx, dl); err != nil {
+		glog.Errorf("Failed to add dead letter '%s': %v", dl.Request.Key(), err)
+	}
+}
+
+// park puts back a request to a host whose circuit breaker is open.
+func (s *SimpleSpider) park(req *Request, until time.Time, why string) {
+	glog.V(2).Infof("Parking '%s' until %v, %s.", req.Key(), until, why)
+	req.NotBefore = until
+	s.frontier.Requeue(req)
+}
+
+// retryLater requeues a failed request if the retrier is a DelayedRetrier that wants to retry it.
+func (s *SimpleSpider) retryLater(req *Request, err error, start time.Time,
+	statsKey StatsKey) bool {
+	r, ok := s.retrier.(DelayedRetrier)
+	if !ok {
+		return false
+	}
+	if req.Attempts == 0 {
+		req.FirstAttempt = start
+	}
+	wait, ok := r.NextRetry(req.Attempts, time.Since(req.FirstAttempt), err)
+	if !ok {
+		return false
+	}
+	glog.V(1).Infof("Failed to crawl '%s', retrying in %v: %v", req.Key(), wait, err)
+	req.Attempts++
+	req.NotBefore = time.Now().Add(wait)
+	s.stats.update(statsKey, func(cs *CrawlStats) { cs.Retries++ })
+	s.frontier.Requeue(req)
+	return true
+}
+
+// finish must be called after the request returned by next() is parsed, so requests queued by
+// the parser are counted before the crawl can become idle.
+func (s *SimpleSpider) finish(req *Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := req.Key()
+	if s.inFlight[key]--; s.inFlight[key] == 0 {
+		delete(s.inFlight, key)
+	}
+	if s.isIdle() {
+		s.idle.Broadcast()
+	}
+}
+
+// allowedByRobots parks the request until robots.txt is fetched again if it's unreachable.
+func (s *SimpleSpider) allowedByRobots(ctx context.Context, req *Request) (allowed,
+	parked bool) {
+	robots := s.robots
+	if robots == nil {
+		return true, false
+	}
+	allowed, crawlDelay, retryAt := robots.check(ctx, req.URL)
+	if ctx.Err() != nil {
+		return false, false
+	} else if !retryAt.IsZero() {
+		s.park(req, retryAt, "robots.txt unreachable")
+		return false, true
+	} else if !allowed {
+		if s.blocked != nil {
+			s.blocked(req)
+		} else {
+			glog.V(0).Infof("Not crawling '%s', disallowed by robots.txt.", req.Key())
+		}
+		return false, false
+	}
+	s.polite.setCrawlDelay(req.URL, crawlDelay)
+	return true, false
+}
+
+// parse runs the parsers of the rules matching the response. If there are several, each reads
+// its own copy of the body.
+func (s *SimpleSpider) parse(ctx context.Context, req *Request, resp *http.Response,
+	attempts int, statsKey StatsKey) {
+	contentType := resp.Header.Get("Content-Type")
+	_, parsers := s.router.parsers(req.URL, req.method(), contentType)
+	if len(parsers) == 0 {
+		glog.V(1).Infof("No parser for '%s' of type '%s'.", req.Key(), contentType)
+		return
+	}
+	ctx = withContentType(ctx, contentType)
+	var body []byte
+	if len(parsers) > 1 {
+		var err error
+		if body, err = ioutil.ReadAll(resp.Body); err != nil {
+			glog.V(0).Infof("Failed to read '%s': %v", req.Key(), err)
+			return
+		}
+	}
+	for _, dp := range parsers {
+		parsed := resp
+		if body != nil {
+			copied := *resp
+			copied.Body = ioutil.NopCloser(bytes.NewReader(body))
+			parsed = &copied
+		}
+		if err := dp.Parse(ctx, req, parsed, parserSpider{s}); err != nil {
+			glog.V(0).Infof("Failed to parse '%s': %v", req.Key(), err)
+			s.stats.update(statsKey, func(cs *CrawlStats) { cs.ParseErrors++ })
+			s.addDeadLetter(ctx, newDeadLetter(req, DEAD_LETTER_PARSE, attempts, err,
+				resp.StatusCode))
 		}
 	}
-	s.retrier.RunWithRetry(func() error {
-		resp, err = crawler(urlStr)
+}
+
+// crawl returns how many attempts it made, which is at most one with a DelayedRetrier.
+func (s *SimpleSpider) crawl(ctx context.Context, req *Request, statsKey StatsKey) (
+	resp *http.Response, attempts int, err error) {
+	crawler := s.router.crawler(req)
+	// The politeness slot is held until the body is closed, since that's when the download ends.
+	var release func()
+	job := func() error {
+		var acquireErr error
+		release, acquireErr = s.polite.acquire(ctx, req.URL)
+		if acquireErr != nil {
+			resp, err, release = nil, acquireErr, nil
+			return err
+		}
+		attempts++
+		if resp, err = s.fetch(ctx, crawler, req, statsKey); err != nil {
+			release()
+			release = nil
+		}
 		return err
-	})
+	}
+	// DelayedRetriers retry through the frontier instead, see retryLater.
+	if _, ok := s.retrier.(DelayedRetrier); ok {
+		job()
+	} else if retryErr := s.retrier.RunWithRetry(ctx, job); retryErr != nil && err == nil {
+		err = retryErr
+	}
+	if attempts > 1 {
+		s.stats.update(statsKey, func(cs *CrawlStats) { cs.Retries += uint64(attempts - 1) })
+	}
+	if err != nil {
+		if release != nil {
+			resp.Body.Close()
+			release()
+		}
+		return nil, attempts, err
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, onClose: func(n uint64) {
+		release()
+		s.stats.update(statsKey, func(cs *CrawlStats) { cs.Bytes += n })
+	}}
 	return
 }
+
+// fetch makes one attempt, through the middlewares.
+func (s *SimpleSpider) fetch(ctx context.Context, crawler Crawler, req *Request,
+	statsKey StatsKey) (resp *http.Response, err error) {
+	attempt := req.clone()
+	defer func() {
+		if err != nil {
+			for i := len(s.mws) - 1; i >= 0; i-- {
+				s.mws[i].OnError(ctx, attempt, err)
+			}
+		}
+	}()
+	for _, m := range s.mws {
+		if err := m.OnRequest(ctx, attempt); err != nil {
+			return nil, err
+		}
+	}
+	if attempt.Header.Get("User-Agent") == "" {
+		if attempt.Header == nil {
+			attempt.Header = make(http.Header)
+		}
+		attempt.Header.Set("User-Agent", s.userAgent)
+	}
+	start := time.Now()
+	resp, err = crawler.Crawl(ctx, s.client, attempt)
+	latency := time.Since(start)
+	s.stats.fetched(statsKey, resp, err, latency)
+	if ctx.Err() == nil {
+		s.polite.adjust(req.URL, latency, resp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := len(s.mws) - 1; i >= 0; i-- {
+		if err := s.mws[i].OnResponse(ctx, attempt, resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	if r, ok := s.retrier.(StatusRetrier); ok && r.RetryStatus(resp.StatusCode) {
+		resp.Body.Close()
+		return nil, newStatusError(resp)
+	}
+	return resp, nil
+}
@@ -0,0 +1,50 @@
+package dspider
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// blockingFrontier's Pop blocks until unblocked, like a RemoteFrontier waiting on its
+// coordinator.
+type blockingFrontier struct {
+	*MemFrontier
+	popping chan struct{}
+	unblock chan struct{}
+}
+
+func (f *blockingFrontier) Pop() (*Request, bool) {
+	select {
+	case f.popping <- struct{}{}:
+	default:
+	}
+	<-f.unblock
+	return f.MemFrontier.Pop()
+}
+
+func TestSpiderDoesNotLockDuringFrontierCalls(t *testing.T) {
+	f := &blockingFrontier{MemFrontier: NewMemFrontier(), popping: make(chan struct{}, 1),
+		unblock: make(chan struct{})}
+	s := NewSimpleSpiderWithFrontier(http.DefaultClient, 1, &SimpleRetrier{}, f)
+	s.DisableRobots()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	<-f.popping
+
+	done := make(chan struct{})
+	go func() {
+		s.Queue("http://example.com/")
+		s.Stats()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Queue and Stats waited for the frontier's Pop")
+	}
+	cancel()
+	close(f.unblock)
+	s.Shutdown(context.Background())
+}
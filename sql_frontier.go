@@ -0,0 +1,239 @@
+package dspider
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	FRONTIER_TABLE_NAME = "frontier"
+
+	FRONTIER_QUEUED    = 0
+	FRONTIER_IN_FLIGHT = 1
+	FRONTIER_DONE      = 2
+)
+
+// SqlFrontier persists every request with its state, so a restarted spider resumes where the
+// previous run stopped. Requests that were in flight when the previous run died are queued
+// again. The url column holds Request.Key, and the request column the JSON encoded request.
+// not_before is Request.NotBefore in Unix nanoseconds, 0 if unset.
+// Like MemFrontier, it takes turns between hosts and pops each host's requests by priority.
+type SqlFrontier struct {
+	mu       sync.Mutex
+	db       *sql.DB
+	dialect  Dialect
+	nextSeq  int64
+	queued   int
+	lastHost string
+}
+
+func NewSqlFrontier(driver, fileName string) (*SqlFrontier, error) {
+	db, err := sql.Open(driver, fileName)
+	if err != nil {
+		return nil, err
+	}
+	f := &SqlFrontier{db: db, dialect: DialectOf(driver)}
+	if err := f.init(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *SqlFrontier) init() error {
+	// createTable adds the columns that frontiers of older versions miss.
+	if err := createTable(f.db, f.dialect, SqlTableDef{
+		Name: FRONTIER_TABLE_NAME,
+		Columns: map[string]string{
+			"seq":        "INTEGER NOT NULL",
+			"url":        "TEXT NOT NULL",
+			"request":    "TEXT",
+			"host":       "TEXT NOT NULL DEFAULT ''",
+			"priority":   "INTEGER NOT NULL DEFAULT 0",
+			"not_before": "INTEGER NOT NULL DEFAULT 0",
+			"state":      "INTEGER NOT NULL",
+		},
+		PrimaryKeys: []string{"url"},
+		// Pop skips done requests and walks hosts in order without scanning the table.
+		Indexes: []string{"state,host,priority,seq"},
+	}); err != nil {
+		return err
+	}
+	if _, err := f.db.Exec(rebind(f.dialect, fmt.Sprintf("UPDATE %s SET state = ? WHERE state = ?",
+		FRONTIER_TABLE_NAME)), FRONTIER_QUEUED, FRONTIER_IN_FLIGHT); err != nil {
+		return fmt.Errorf("failed to reset in-flight requests: %v", err)
+	}
+	var maxSeq sql.NullInt64
+	if err := f.db.QueryRow(fmt.Sprintf("SELECT MAX(seq) FROM %s",
+		FRONTIER_TABLE_NAME)).Scan(&maxSeq); err != nil {
+		return err
+	}
+	f.nextSeq = maxSeq.Int64 + 1
+	if err := f.db.QueryRow(rebind(f.dialect, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE state = ?",
+		FRONTIER_TABLE_NAME)), FRONTIER_QUEUED).Scan(&f.queued); err != nil {
+		return err
+	}
+	if f.queued > 0 {
+		glog.Infof("Resuming %d queued requests.", f.queued)
+	}
+	return nil
+}
+
+func (f *SqlFrontier) Close() error {
+	return f.db.Close()
+}
+
+// Seen returns whether a request with the key was ever pushed, including by previous runs.
+func (f *SqlFrontier) Seen(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	seen, err := f.seen(key)
+	if err != nil {
+		glog.Errorf("Failed to look up '%s': %v", key, err)
+	}
+	return seen
+}
+
+func (f *SqlFrontier) seen(key string) (bool, error) {
+	var n int
+	err := f.db.QueryRow(rebind(f.dialect, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE url = ?",
+		FRONTIER_TABLE_NAME)), key).Scan(&n)
+	return n > 0, err
+}
+
+func (f *SqlFrontier) Push(req *Request) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := req.Key()
+	if seen, err := f.seen(key); err != nil {
+		glog.Errorf("Failed to look up '%s': %v", key, err)
+		return false
+	} else if seen {
+		return false
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		glog.Errorf("Failed to encode '%s': %v", key, err)
+		return false
+	}
+	if _, err := f.db.Exec(rebind(f.dialect, fmt.Sprintf(
+		"INSERT INTO %s (seq, url, request, host, priority, state) VALUES (?, ?, ?, ?, ?, ?)",
+		FRONTIER_TABLE_NAME)), f.nextSeq, key, string(data), hostOf(req.URL), req.Priority,
+		FRONTIER_QUEUED); err != nil {
+		glog.Errorf("Failed to queue '%s': %v", key, err)
+		return false
+	}
+	f.nextSeq++
+	f.queued++
+	return true
+}
+
+func (f *SqlFrontier) Pop() (*Request, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for f.queued > 0 {
+		req, ok, retry := f.pop()
+		if !retry {
+			return req, ok
+		}
+	}
+	return nil, false
+}
+
+// pop returns retry if the popped request couldn't be decoded, which is then dropped.
+func (f *SqlFrontier) pop() (req *Request, ok, retry bool) {
+	var key, host string
+	var data sql.NullString
+	// Take the next host after the last one, wrapping around.
+	query := fmt.Sprintf("SELECT url, request, host FROM %s "+
+		"WHERE state = ? AND not_before <= ? AND host > ? "+
+		"ORDER BY host, priority DESC, seq LIMIT 1", FRONTIER_TABLE_NAME)
+	now := time.Now().UnixNano()
+	err := f.db.QueryRow(rebind(f.dialect, query), FRONTIER_QUEUED, now,
+		f.lastHost).Scan(&key, &data, &host)
+	if err == sql.ErrNoRows {
+		err = f.db.QueryRow(rebind(f.dialect, strings.Replace(query, "host > ?", "host >= ?", 1)),
+			FRONTIER_QUEUED, now, "").Scan(&key, &data, &host)
+	}
+	if err == sql.ErrNoRows {
+		// Everything queued waits to be retried.
+		return nil, false, false
+	} else if err != nil {
+		glog.Errorf("Failed to pop request: %v", err)
+		return nil, false, false
+	}
+	f.lastHost = host
+	req = NewRequest(key)
+	state := FRONTIER_IN_FLIGHT
+	if data.Valid {
+		if err := json.Unmarshal([]byte(data.String), req); err != nil {
+			// It would fail again, so don't leave it queued.
+			glog.Errorf("Failed to decode '%s', dropping it: %v", key, err)
+			state, retry = FRONTIER_DONE, true
+		}
+	}
+	if err := f.setState(key, state); err != nil {
+		glog.Errorf("Failed to pop '%s': %v", key, err)
+		return nil, false, false
+	}
+	f.queued--
+	if retry {
+		return nil, false, true
+	}
+	return req, true, false
+}
+
+func (f *SqlFrontier) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queued
+}
+
+func (f *SqlFrontier) MarkDone(req *Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.setState(req.Key(), FRONTIER_DONE); err != nil {
+		glog.Errorf("Failed to mark '%s' done: %v", req.Key(), err)
+	}
+}
+
+// Requeue returns false if the request was never pushed.
+func (f *SqlFrontier) Requeue(req *Request) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := req.Key()
+	data, err := json.Marshal(req)
+	if err != nil {
+		glog.Errorf("Failed to encode '%s': %v", key, err)
+		return false
+	}
+	var notBefore int64
+	if !req.NotBefore.IsZero() {
+		notBefore = req.NotBefore.UnixNano()
+	}
+	result, err := f.db.Exec(rebind(f.dialect, fmt.Sprintf(
+		"UPDATE %s SET request = ?, priority = ?, not_before = ?, state = ? WHERE url = ?",
+		FRONTIER_TABLE_NAME)), string(data), req.Priority, notBefore, FRONTIER_QUEUED, key)
+	if err != nil {
+		glog.Errorf("Failed to requeue '%s': %v", key, err)
+		return false
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		glog.Errorf("Failed to requeue '%s', it was never queued.", key)
+		return false
+	}
+	f.queued++
+	return true
+}
+
+func (f *SqlFrontier) setState(key string, state int) error {
+	_, err := f.db.Exec(rebind(f.dialect, fmt.Sprintf("UPDATE %s SET state = ? WHERE url = ?",
+		FRONTIER_TABLE_NAME)), state, key)
+	return err
+}
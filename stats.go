@@ -0,0 +1,238 @@
+package dspider
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LATENCY_BUCKETS are the upper bounds of the fetch latency histogram, in seconds.
+var LATENCY_BUCKETS = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type Histogram struct {
+	// Counts[i] counts the observations <= Buckets[i]. Larger ones are only in Count.
+	Buckets []float64
+	Counts  []uint64
+	Sum     float64
+	Count   uint64
+}
+
+func (h *Histogram) observe(v float64) {
+	if h.Counts == nil {
+		h.Buckets = LATENCY_BUCKETS
+		h.Counts = make([]uint64, len(h.Buckets))
+	}
+	for i, le := range h.Buckets {
+		if v <= le {
+			h.Counts[i]++
+		}
+	}
+	h.Sum += v
+	h.Count++
+}
+
+// StatsKey is what stats are broken down by. Rule is the regex of the DocParser or Storage
+// that handled the URL.
+type StatsKey struct {
+	Host string
+	Rule string
+}
+
+type CrawlStats struct {
+	Requests      uint64
+	StatusCodes   map[int]uint64
+	Bytes         uint64
+	Latency       Histogram
+	FetchErrors   uint64
+	ParseErrors   uint64
+	StorageErrors uint64
+	Retries       uint64
+}
+
+type Stats struct {
+	Queued   int
+	InFlight int
+	ByKey    map[StatsKey]*CrawlStats
+	// Breakers has the state of each host's circuit breaker, e.g. BREAKER_OPEN.
+	Breakers map[string]int
+	// Throttle has the auto-throttle delay of each host.
+	Throttle map[string]time.Duration
+}
+
+type statsCollector struct {
+	mu    sync.Mutex
+	byKey map[StatsKey]*CrawlStats
+}
+
+func newStatsCollector() *statsCollector {
+	return &statsCollector{byKey: make(map[StatsKey]*CrawlStats)}
+}
+
+// get must be called with c.mu held.
+func (c *statsCollector) get(key StatsKey) *CrawlStats {
+	cs := c.byKey[key]
+	if cs == nil {
+		cs = &CrawlStats{StatusCodes: make(map[int]uint64)}
+		c.byKey[key] = cs
+	}
+	return cs
+}
+
+func (c *statsCollector) update(key StatsKey, f func(cs *CrawlStats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f(c.get(key))
+}
+
+func (c *statsCollector) fetched(key StatsKey, resp *http.Response, err error,
+	latency time.Duration) {
+	c.update(key, func(cs *CrawlStats) {
+		cs.Requests++
+		cs.Latency.observe(latency.Seconds())
+		if err != nil {
+			cs.FetchErrors++
+		} else {
+			cs.StatusCodes[resp.StatusCode]++
+		}
+	})
+}
+
+func (c *statsCollector) snapshot() map[StatsKey]*CrawlStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	byKey := make(map[StatsKey]*CrawlStats, len(c.byKey))
+	for key, cs := range c.byKey {
+		copied := *cs
+		copied.StatusCodes = make(map[int]uint64, len(cs.StatusCodes))
+		for code, n := range cs.StatusCodes {
+			copied.StatusCodes[code] = n
+		}
+		copied.Latency.Counts = append([]uint64(nil), cs.Latency.Counts...)
+		byKey[key] = &copied
+	}
+	return byKey
+}
+
+// countingBody counts the bytes read from a response body, and reports them when closed.
+type countingBody struct {
+	io.ReadCloser
+	n       uint64
+	onClose func(n uint64)
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += uint64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	if b.onClose != nil {
+		b.onClose(b.n)
+		b.onClose = nil
+	}
+	return b.ReadCloser.Close()
+}
+
+// WritePrometheus writes the stats in the Prometheus text exposition format.
+func (st *Stats) WritePrometheus(w io.Writer) {
+	keys := make([]StatsKey, 0, len(st.ByKey))
+	for key := range st.ByKey {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Host != keys[j].Host {
+			return keys[i].Host < keys[j].Host
+		}
+		return keys[i].Rule < keys[j].Rule
+	})
+	labels := func(key StatsKey) string {
+		return fmt.Sprintf(`host="%s",rule="%s"`, escapeLabel(key.Host), escapeLabel(key.Rule))
+	}
+	counter := func(name, help string, value func(cs *CrawlStats) uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, labels(key), value(st.ByKey[key]))
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP dspider_queued Requests waiting in the frontier.\n")
+	fmt.Fprintf(w, "# TYPE dspider_queued gauge\ndspider_queued %d\n", st.Queued)
+	fmt.Fprintf(w, "# HELP dspider_in_flight Requests being crawled.\n")
+	fmt.Fprintf(w, "# TYPE dspider_in_flight gauge\ndspider_in_flight %d\n", st.InFlight)
+	counter("dspider_requests_total", "HTTP requests sent, including retries.",
+		func(cs *CrawlStats) uint64 { return cs.Requests })
+	counter("dspider_fetch_errors_total", "HTTP requests that failed without a response.",
+		func(cs *CrawlStats) uint64 { return cs.FetchErrors })
+	counter("dspider_response_bytes_total", "Bytes of response bodies read.",
+		func(cs *CrawlStats) uint64 { return cs.Bytes })
+	counter("dspider_retries_total", "Retried HTTP requests.",
+		func(cs *CrawlStats) uint64 { return cs.Retries })
+	counter("dspider_parse_errors_total", "Errors returned by DocParsers.",
+		func(cs *CrawlStats) uint64 { return cs.ParseErrors })
+	counter("dspider_storage_errors_total", "Errors returned by Storages.",
+		func(cs *CrawlStats) uint64 { return cs.StorageErrors })
+
+	fmt.Fprintf(w, "# HELP dspider_responses_total HTTP responses by status code.\n")
+	fmt.Fprintf(w, "# TYPE dspider_responses_total counter\n")
+	for _, key := range keys {
+		cs := st.ByKey[key]
+		codes := make([]int, 0, len(cs.StatusCodes))
+		for code := range cs.StatusCodes {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			fmt.Fprintf(w, "dspider_responses_total{%s,code=\"%d\"} %d\n", labels(key), code,
+				cs.StatusCodes[code])
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP dspider_circuit_breaker_state "+
+		"Circuit breaker state by host, 0 closed, 1 open, 2 half-open.\n")
+	fmt.Fprintf(w, "# TYPE dspider_circuit_breaker_state gauge\n")
+	hosts := make([]string, 0, len(st.Breakers))
+	for host := range st.Breakers {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		fmt.Fprintf(w, "dspider_circuit_breaker_state{host=\"%s\"} %d\n", escapeLabel(host),
+			st.Breakers[host])
+	}
+
+	fmt.Fprintf(w, "# HELP dspider_throttle_delay_seconds Auto-throttle delay by host.\n")
+	fmt.Fprintf(w, "# TYPE dspider_throttle_delay_seconds gauge\n")
+	hosts = hosts[:0]
+	for host := range st.Throttle {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		fmt.Fprintf(w, "dspider_throttle_delay_seconds{host=\"%s\"} %g\n", escapeLabel(host),
+			st.Throttle[host].Seconds())
+	}
+
+	fmt.Fprintf(w, "# HELP dspider_fetch_latency_seconds Time to get response headers.\n")
+	fmt.Fprintf(w, "# TYPE dspider_fetch_latency_seconds histogram\n")
+	for _, key := range keys {
+		h := st.ByKey[key].Latency
+		for i, le := range h.Buckets {
+			fmt.Fprintf(w, "dspider_fetch_latency_seconds_bucket{%s,le=\"%s\"} %d\n", labels(key),
+				strconv.FormatFloat(le, 'g', -1, 64), h.Counts[i])
+		}
+		fmt.Fprintf(w, "dspider_fetch_latency_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels(key),
+			h.Count)
+		fmt.Fprintf(w, "dspider_fetch_latency_seconds_sum{%s} %g\n", labels(key), h.Sum)
+		fmt.Fprintf(w, "dspider_fetch_latency_seconds_count{%s} %d\n", labels(key), h.Count)
+	}
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -2,9 +2,11 @@ package dspider
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 
@@ -16,39 +18,158 @@ const (
 	SQL_STRUCT_TAG_TABLE = "table"
 )
 
+const (
+	// Conflict actions, for rows whose primary key is already in the table.
+	CONFLICT_ERROR = iota
+	CONFLICT_IGNORE
+	CONFLICT_REPLACE
+	// CONFLICT_UPDATE updates ConflictPolicy.UpdateColumns.
+	CONFLICT_UPDATE
+	// CONFLICT_KEEP_NEWEST updates like CONFLICT_UPDATE, but only if the new row's
+	// ConflictPolicy.NewestColumn is greater.
+	CONFLICT_KEEP_NEWEST
+)
+
 type Storage interface {
-	AddDoc(doc interface{}) error
+	AddDoc(ctx context.Context, doc interface{}) error
 }
 
 type SqlStorage struct {
-	mu sync.Mutex
-	db *sql.DB
+	mu      sync.Mutex
+	db      *sql.DB
+	dialect Dialect
+	tables  map[string]SqlTableDef
+	// Batching, see SetBatching.
+	batchSize int
+	pending   []sqlRow
+	failed    []SqlRowError
+	flushMu   sync.Mutex
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+type ConflictPolicy struct {
+	Action int
+	// UpdateColumns defaults to all the columns but the primary keys.
+	UpdateColumns []string
+	NewestColumn  string
 }
 
 type SqlTableDef struct {
-	Name        string
-	Columns     map[string]string
+	Name string
+	// Columns maps the column names to their definitions, see Dialect for the types.
+	Columns map[string]string
+	// PrimaryKeys defaults to the columns defined as PRIMARY KEY.
 	PrimaryKeys []string
+	// Indexes are columns to index. An entry can list several comma separated columns to index
+	// together.
+	Indexes    []string
+	OnConflict ConflictPolicy
+}
+
+func (def *SqlTableDef) primaryKeys() []string {
+	if len(def.PrimaryKeys) > 0 {
+		return def.PrimaryKeys
+	}
+	var keys []string
+	for col, body := range def.Columns {
+		if strings.Contains(strings.ToUpper(body), "PRIMARY KEY") {
+			keys = append(keys, col)
+		}
+	}
+	sort.Strings(keys)
+	return keys
 }
 
+// updateColumns returns the columns to update on conflicts, out of the inserted ones.
+func (def *SqlTableDef) updateColumns(columns []string) []string {
+	var update []string
+	if def.OnConflict.Action != CONFLICT_REPLACE && len(def.OnConflict.UpdateColumns) > 0 {
+		inserted := make(map[string]bool)
+		for _, col := range columns {
+			inserted[col] = true
+		}
+		for _, col := range def.OnConflict.UpdateColumns {
+			if inserted[col] {
+				update = append(update, col)
+			}
+		}
+		return update
+	}
+	keys := make(map[string]bool)
+	for _, key := range def.primaryKeys() {
+		keys[key] = true
+	}
+	for _, col := range columns {
+		if !keys[col] {
+			update = append(update, col)
+		}
+	}
+	return update
+}
+
+func (def *SqlTableDef) checkConflictPolicy(d Dialect) error {
+	p := def.OnConflict
+	// MySQL updates rows that conflict on any unique key, and PostgreSQL replaces rows by updating
+	// them, which needs a key.
+	_, mysql := d.(MysqlDialect)
+	_, postgres := d.(PostgresDialect)
+	switch {
+	case p.Action < CONFLICT_ERROR || p.Action > CONFLICT_KEEP_NEWEST:
+		return fmt.Errorf("table '%s' has an unknown conflict action %d", def.Name, p.Action)
+	case p.Action == CONFLICT_KEEP_NEWEST && p.NewestColumn == "":
+		return fmt.Errorf("table '%s' keeps the newest rows, but has no NewestColumn", def.Name)
+	case p.Action >= CONFLICT_UPDATE && len(def.primaryKeys()) == 0 && !mysql:
+		return fmt.Errorf("table '%s' updates conflicting rows, but has no primary key",
+			def.Name)
+	case p.Action == CONFLICT_REPLACE && len(def.primaryKeys()) == 0 && postgres:
+		return fmt.Errorf("table '%s' replaces conflicting rows, but has no primary key",
+			def.Name)
+	}
+	return nil
+}
+
+// NewSqlStorage writes in the dialect of the driver, see DialectOf.
 func NewSqlStorage(driver, fileName string, tableDefs []SqlTableDef) (*SqlStorage, error) {
 	db, err := sql.Open(driver, fileName)
 	if err != nil {
 		return nil, err
 	}
+	dialect := DialectOf(driver)
+	tables := make(map[string]SqlTableDef)
 	for _, def := range tableDefs {
-		if err := createTable(db, def); err != nil {
+		if err := def.checkConflictPolicy(dialect); err != nil {
+			db.Close()
+			return nil, err
+		}
+		if err := createTable(db, dialect, def); err != nil {
+			db.Close()
 			return nil, err
 		}
+		tables[def.Name] = def
 	}
-	return &SqlStorage{db: db}, nil
+	return &SqlStorage{db: db, dialect: dialect, tables: tables}, nil
 }
 
+// Close writes the pending rows, and returns a *SqlWriteError if any rows failed since the last
+// Flush. Closing again does nothing.
 func (s *SqlStorage) Close() error {
-	return s.db.Close()
+	var err error
+	s.closeOnce.Do(func() {
+		if s.stop != nil {
+			close(s.stop)
+			<-s.stopped
+		}
+		err = s.Flush(context.Background())
+		if closeErr := s.db.Close(); err == nil {
+			err = closeErr
+		}
+	})
+	return err
 }
 
-func (s *SqlStorage) AddDoc(doc interface{}) error {
+func (s *SqlStorage) AddDoc(ctx context.Context, doc interface{}) error {
 	t := reflect.TypeOf(doc)
 	if t.Kind() != reflect.Ptr {
 		glog.Fatalf("Expecting a struct pointer, got %v", t)
@@ -60,7 +181,8 @@ func (s *SqlStorage) AddDoc(doc interface{}) error {
 	for i := 0; i < t.NumField(); i++ {
 		sf := t.Field(i)
 		fv := v.Field(i)
-		if column := sf.Tag.Get(SQL_STRUCT_TAG_NAME); column == SQL_STRUCT_TAG_TABLE {
+		column, _ := parseSqlTag(sf.Tag.Get(SQL_STRUCT_TAG_NAME))
+		if column == SQL_STRUCT_TAG_TABLE {
 			if sf.Type.Kind() != reflect.String {
 				glog.Fatalf("The field with 'table' tag should be string, got: %v", sf.Type)
 			}
@@ -72,35 +194,62 @@ func (s *SqlStorage) AddDoc(doc interface{}) error {
 			columnMap[column] = fv.Interface()
 		}
 	}
-	return s.insert(table, columnMap)
+	return s.insert(ctx, table, columnMap)
 }
 
-func (s *SqlStorage) insert(table string, columnMap map[string]interface{}) error {
-	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "INSERT INTO %s (", table)
-	var args []interface{}
-	first := true
-	for name, value := range columnMap {
-		if first {
-			first = false
-		} else {
-			buf.WriteString(", ")
-		}
-		buf.WriteString(name)
-		args = append(args, value)
+func (s *SqlStorage) insert(ctx context.Context, table string,
+	columnMap map[string]interface{}) error {
+	columns := make([]string, 0, len(columnMap))
+	for name := range columnMap {
+		columns = append(columns, name)
+	}
+	sort.Strings(columns)
+	args := make([]interface{}, len(columns))
+	for i, name := range columns {
+		args[i] = columnMap[name]
+	}
+	def, ok := s.tables[table]
+	if !ok {
+		def = SqlTableDef{Name: table}
+	}
+	row := sqlRow{
+		table:   table,
+		columns: columns,
+		args:    args,
+		query:   s.dialect.Insert(&def, columns),
 	}
-	buf.WriteString(") VALUES (")
-	buf.WriteString(strings.Repeat("?, ", len(args)-1))
-	buf.WriteString("?)")
 	s.mu.Lock()
+	if s.batchSize > 0 {
+		s.pending = append(s.pending, row)
+		full := len(s.pending) >= s.batchSize
+		s.mu.Unlock()
+		if full {
+			// The batch holds rows of other requests, which ctx mustn't fail.
+			s.flushPending(context.Background())
+		}
+		return nil
+	}
 	defer s.mu.Unlock()
-	_, err := s.db.Exec(buf.String(), args...)
+	_, err := s.db.ExecContext(ctx, row.query, row.args...)
 	return err
 }
 
-func createTable(db *sql.DB, def SqlTableDef) error {
+// createTable creates the table if it doesn't exist, and otherwise migrates it to def.
+func createTable(db *sql.DB, d Dialect, def SqlTableDef) error {
+	keys := make(map[string]bool)
+	for _, col := range def.primaryKeys() {
+		keys[col] = true
+	}
+	indexes := make([][]string, len(def.Indexes))
+	for i, index := range def.Indexes {
+		for _, col := range strings.Split(index, ",") {
+			col = strings.TrimSpace(col)
+			indexes[i] = append(indexes[i], col)
+			keys[col] = true
+		}
+	}
 	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "CREATE TABLE IF NOT EXISTS %s (", def.Name)
+	fmt.Fprintf(&buf, "CREATE TABLE IF NOT EXISTS %s (", d.Quote(def.Name))
 	first := true
 	for col, body := range def.Columns {
 		if first {
@@ -108,14 +257,23 @@ func createTable(db *sql.DB, def SqlTableDef) error {
 		} else {
 			buf.WriteString(",")
 		}
-		fmt.Fprintf(&buf, "\n    %s %s", col, body)
+		fmt.Fprintf(&buf, "\n    %s %s", d.Quote(col), d.Column(body, keys[col]))
 	}
 	if len(def.PrimaryKeys) > 0 {
-		fmt.Fprintf(&buf, ",\n   PRIMARY KEY(%s)", strings.Join(def.PrimaryKeys, ", "))
+		fmt.Fprintf(&buf, ",\n   PRIMARY KEY(%s)", quoteAll(d, def.PrimaryKeys))
 	}
 	buf.WriteString("\n)")
 	if _, err := db.Exec(buf.String()); err != nil {
 		return fmt.Errorf("failed to create table '%s': %v", def.Name, err)
 	}
+	if err := migrateTable(db, d, def, keys); err != nil {
+		return err
+	}
+	for _, cols := range indexes {
+		if err := d.CreateIndex(db, def.Name, cols); err != nil {
+			return fmt.Errorf("failed to index '%s(%s)': %v", def.Name, strings.Join(cols, ", "),
+				err)
+		}
+	}
 	return nil
 }
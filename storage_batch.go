@@ -0,0 +1,136 @@
+package dspider
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+type sqlRow struct {
+	table   string
+	columns []string
+	args    []interface{}
+	query   string
+}
+
+// SqlRowError is a row SqlStorage failed to write.
+type SqlRowError struct {
+	Table   string
+	Columns map[string]interface{}
+	Err     error
+}
+
+// SqlWriteError lists the rows of batches that failed to write.
+type SqlWriteError struct {
+	Rows []SqlRowError
+}
+
+func (e *SqlWriteError) Error() string {
+	errs := make([]string, 0, len(e.Rows))
+	for _, row := range e.Rows {
+		errs = append(errs, fmt.Sprintf("%s: %v", row.Table, row.Err))
+	}
+	return fmt.Sprintf("failed to write %d rows: %s", len(e.Rows), strings.Join(errs, "; "))
+}
+
+// SetBatching buffers rows, and writes them in one transaction once there are size of them, or
+// every interval if that's not 0. AddDoc then can't report write errors; Flush and Close
+// report them as a *SqlWriteError. It must be called before the first AddDoc.
+func (s *SqlStorage) SetBatching(size int, interval time.Duration) {
+	s.batchSize = size
+	if interval > 0 {
+		s.stop = make(chan struct{})
+		s.stopped = make(chan struct{})
+		go s.flushLoop(interval)
+	}
+}
+
+func (s *SqlStorage) flushLoop(interval time.Duration) {
+	defer close(s.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flushPending(context.Background())
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Flush writes the pending rows, and returns a *SqlWriteError if any rows failed since the last
+// Flush.
+func (s *SqlStorage) Flush(ctx context.Context) error {
+	s.flushPending(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.failed) == 0 {
+		return nil
+	}
+	err := &SqlWriteError{Rows: s.failed}
+	s.failed = nil
+	return err
+}
+
+// flushPending writes the pending rows in a transaction. If it fails, the rows are written one
+// by one, to only fail the bad ones.
+func (s *SqlStorage) flushPending(ctx context.Context) {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.mu.Lock()
+	rows := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if len(rows) == 0 {
+		return
+	}
+	err := s.writeBatch(ctx, rows)
+	if err == nil {
+		glog.V(1).Infof("Wrote %d rows.", len(rows))
+		return
+	}
+	glog.Warningf("Failed to write a batch of %d rows, writing them one by one: %v", len(rows),
+		err)
+	var failed []SqlRowError
+	for _, row := range rows {
+		if _, err := s.db.ExecContext(ctx, row.query, row.args...); err != nil {
+			columns := make(map[string]interface{}, len(row.columns))
+			for i, col := range row.columns {
+				columns[col] = row.args[i]
+			}
+			glog.Errorf("Failed to write a row into '%s': %v", row.table, err)
+			failed = append(failed, SqlRowError{Table: row.table, Columns: columns, Err: err})
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed = append(s.failed, failed...)
+}
+
+func (s *SqlStorage) writeBatch(ctx context.Context, rows []sqlRow) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmts := make(map[string]*sql.Stmt)
+	for _, row := range rows {
+		stmt := stmts[row.query]
+		if stmt == nil {
+			if stmt, err = tx.PrepareContext(ctx, row.query); err != nil {
+				return err
+			}
+			defer stmt.Close()
+			stmts[row.query] = stmt
+		}
+		if _, err := stmt.ExecContext(ctx, row.args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,109 @@
+package dspider
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// SCHEMA_TABLE_NAME records the version and columns of each table, bumped whenever
+// migrateTable changes it.
+const SCHEMA_TABLE_NAME = "dspider_schema"
+
+var notNullRegexp = regexp.MustCompile(`(?i)\s*NOT\s+NULL`)
+var primaryKeyRegexp = regexp.MustCompile(`(?i)\s*PRIMARY\s+KEY(\s+AUTOINCREMENT)?`)
+
+// baseType is the type of a column definition, without size or constraints.
+func baseType(body string) string {
+	typ := strings.ToUpper(strings.TrimSpace(body))
+	if i := strings.IndexAny(typ, " ("); i >= 0 {
+		typ = typ[:i]
+	}
+	return typ
+}
+
+// migrateTable adds the columns of def that an existing table misses, warns about columns whose
+// types differ, and records the table's schema version.
+func migrateTable(db *sql.DB, d Dialect, def SqlTableDef, keys map[string]bool) error {
+	types, err := d.ColumnTypes(db, def.Name)
+	if err != nil {
+		return fmt.Errorf("failed to read columns of '%s': %v", def.Name, err)
+	}
+	cols := make([]string, 0, len(def.Columns))
+	for col := range def.Columns {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+	var added []string
+	for _, col := range cols {
+		body := d.Column(def.Columns[col], keys[col])
+		typ, ok := types[strings.ToUpper(col)]
+		if ok {
+			if want := baseType(body); typ != "" && want != "" && baseType(typ) != want {
+				glog.Warningf("Column '%s.%s' is %s, but defined as %s.", def.Name, col, typ,
+					body)
+			}
+			continue
+		}
+		// Added columns can't be keys, and need a default to be NOT NULL.
+		body = primaryKeyRegexp.ReplaceAllString(body, "")
+		if !strings.Contains(strings.ToUpper(body), "DEFAULT") &&
+			notNullRegexp.MatchString(body) {
+			glog.Warningf("Adding column '%s.%s' as nullable, existing rows have no value.",
+				def.Name, col)
+			body = notNullRegexp.ReplaceAllString(body, "")
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", d.Quote(def.Name),
+			d.Quote(col), body)); err != nil {
+			return fmt.Errorf("failed to add column '%s.%s': %v", def.Name, col, err)
+		}
+		glog.Infof("Added column '%s.%s'.", def.Name, col)
+		added = append(added, col)
+	}
+	return recordSchema(db, d, def.Name, cols, len(added) > 0)
+}
+
+// recordSchema bumps the version of the table if it changed or wasn't recorded yet.
+func recordSchema(db *sql.DB, d Dialect, table string, cols []string, changed bool) error {
+	if _, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n"+
+		"    table_name %s PRIMARY KEY,\n"+
+		"    version %s,\n"+
+		"    columns %s,\n"+
+		"    updated_at %s\n)", SCHEMA_TABLE_NAME, d.Column("TEXT NOT NULL", true),
+		d.Column("INTEGER NOT NULL", false), d.Column("TEXT NOT NULL", false),
+		d.Column("TIMESTAMP NOT NULL", false))); err != nil {
+		return fmt.Errorf("failed to create table '%s': %v", SCHEMA_TABLE_NAME, err)
+	}
+	var version int
+	var recorded string
+	err := db.QueryRow(rebind(d, fmt.Sprintf("SELECT version, columns FROM %s WHERE table_name = ?",
+		SCHEMA_TABLE_NAME)), table).Scan(&version, &recorded)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to read schema version of '%s': %v", table, err)
+	}
+	columns := strings.Join(cols, ",")
+	if err == nil && !changed && recorded == columns {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(rebind(d, fmt.Sprintf("DELETE FROM %s WHERE table_name = ?",
+		SCHEMA_TABLE_NAME)), table); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(rebind(d, fmt.Sprintf(
+		"INSERT INTO %s (table_name, version, columns, updated_at) VALUES (?, ?, ?, ?)",
+		SCHEMA_TABLE_NAME)), table, version+1, columns, time.Now()); err != nil {
+		return fmt.Errorf("failed to record schema version of '%s': %v", table, err)
+	}
+	glog.V(1).Infof("Schema of '%s' is version %d.", table, version+1)
+	return tx.Commit()
+}
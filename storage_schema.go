@@ -0,0 +1,127 @@
+package dspider
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Options of the sql struct tag, after the column name, e.g. `sql:"id,pk"`.
+const (
+	SQL_TAG_PRIMARY_KEY = "pk"
+	SQL_TAG_NOT_NULL    = "notnull"
+	SQL_TAG_INDEX       = "index"
+	// SQL_TAG_TYPE overrides the column type, e.g. `sql:"price,type=DECIMAL(10,2),notnull"`.
+	SQL_TAG_TYPE = "type="
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// parseSqlTag returns the column name and options of a sql struct tag. Commas in parentheses,
+// like in type=DECIMAL(10,2), don't separate options.
+func parseSqlTag(tag string) (column string, options []string) {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range tag {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, tag[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, tag[start:])
+	return parts[0], parts[1:]
+}
+
+func sqlColumnType(t reflect.Type) (string, error) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return "TIMESTAMP", nil
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return "BLOB", nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "BOOLEAN", nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "INTEGER", nil
+	case reflect.Float32, reflect.Float64:
+		return "REAL", nil
+	case reflect.String:
+		return "TEXT", nil
+	}
+	return "", fmt.Errorf("no SQL type for %v", t)
+}
+
+// StructTableDef fills the Columns, PrimaryKeys and Indexes of def from the sql tags of v, a
+// struct or a pointer to one, as written by SqlStorage.AddDoc.
+func StructTableDef(def SqlTableDef, v interface{}) (SqlTableDef, error) {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return def, fmt.Errorf("expecting a struct, got %v", t)
+	}
+	def.Columns = make(map[string]string)
+	def.PrimaryKeys, def.Indexes = nil, nil
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		column, options := parseSqlTag(sf.Tag.Get(SQL_STRUCT_TAG_NAME))
+		if column == "" || column == SQL_STRUCT_TAG_TABLE {
+			continue
+		}
+		typ, err := sqlColumnType(sf.Type)
+		notNull := false
+		for _, option := range options {
+			switch {
+			case option == SQL_TAG_PRIMARY_KEY:
+				def.PrimaryKeys = append(def.PrimaryKeys, column)
+			case option == SQL_TAG_NOT_NULL:
+				notNull = true
+			case option == SQL_TAG_INDEX:
+				def.Indexes = append(def.Indexes, column)
+			case strings.HasPrefix(option, SQL_TAG_TYPE):
+				typ, err = strings.TrimPrefix(option, SQL_TAG_TYPE), nil
+			default:
+				return def, fmt.Errorf("field '%s.%s' has unknown sql tag option '%s'", t.Name(),
+					sf.Name, option)
+			}
+		}
+		if err != nil {
+			return def, fmt.Errorf("field '%s.%s': %v", t.Name(), sf.Name, err)
+		}
+		if notNull {
+			typ += " NOT NULL"
+		}
+		def.Columns[column] = typ
+	}
+	return def, nil
+}
+
+// RegisterStruct creates the table of def with the columns of v, see StructTableDef.
+func (s *SqlStorage) RegisterStruct(def SqlTableDef, v interface{}) error {
+	def, err := StructTableDef(def, v)
+	if err != nil {
+		return err
+	}
+	if err := def.checkConflictPolicy(s.dialect); err != nil {
+		return err
+	}
+	if err := createTable(s.db, s.dialect, def); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tables[def.Name] = def
+	return nil
+}
@@ -0,0 +1,28 @@
+package dspider
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSqlTag(t *testing.T) {
+	for _, test := range []struct {
+		tag     string
+		column  string
+		options []string
+	}{
+		{"id", "id", []string{}},
+		{"id,pk", "id", []string{"pk"}},
+		{"price,type=DECIMAL(10,2)", "price", []string{"type=DECIMAL(10,2)"}},
+		{"price,type=DECIMAL(10,2),notnull", "price", []string{"type=DECIMAL(10,2)", "notnull"}},
+		{"price,index,type=NUMERIC(10, 2),notnull", "price",
+			[]string{"index", "type=NUMERIC(10, 2)", "notnull"}},
+		{"name,type=TEXT,notnull", "name", []string{"type=TEXT", "notnull"}},
+	} {
+		column, options := parseSqlTag(test.tag)
+		if column != test.column || !reflect.DeepEqual(options, test.options) {
+			t.Errorf("%s: got %s %q, want %s %q", test.tag, column, options, test.column,
+				test.options)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package dspider
+
+import (
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	DEFAULT_THROTTLE_START_DELAY = time.Second
+	DEFAULT_THROTTLE_MAX_DELAY   = time.Minute
+)
+
+// AutoThrottle adapts each host's delay and concurrency to how fast it responds, on top of its
+// Politeness. The delay moves towards the latency divided by TargetConcurrency, so that on
+// average TargetConcurrency requests are handled by the host at once. 429 and 503 responses
+// double the delay, or raise it to their Retry-After, and halve the concurrency, which then
+// grows back by one with every successful response. Zero fields take their defaults.
+type AutoThrottle struct {
+	TargetConcurrency float64
+	StartDelay        time.Duration
+	MinDelay          time.Duration
+	MaxDelay          time.Duration
+}
+
+func (a *AutoThrottle) target() float64 {
+	if a.TargetConcurrency > 0 {
+		return a.TargetConcurrency
+	}
+	return 1
+}
+
+func (a *AutoThrottle) startDelay() time.Duration {
+	if a.StartDelay > 0 {
+		return a.StartDelay
+	}
+	return DEFAULT_THROTTLE_START_DELAY
+}
+
+func (a *AutoThrottle) maxConcurrency() int {
+	return int(math.Ceil(a.target()))
+}
+
+func (a *AutoThrottle) clamp(d time.Duration) time.Duration {
+	max := a.MaxDelay
+	if max <= 0 {
+		max = DEFAULT_THROTTLE_MAX_DELAY
+	}
+	if d > max {
+		return max
+	} else if d < a.MinDelay {
+		return a.MinDelay
+	}
+	return d
+}
+
+// throttled tells whether the server asks us to slow down.
+func throttled(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// adjust updates the limiter with a response, or a failure with statusCode 0.
+func (l *limiter) adjust(latency time.Duration, statusCode int, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a := l.auto
+	if a == nil {
+		return
+	}
+	switch {
+	case throttled(statusCode):
+		delay := 2 * l.autoDelay
+		if delay == 0 {
+			delay = a.startDelay()
+		}
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		l.autoDelay = a.clamp(delay)
+		if l.autoConcurrency /= 2; l.autoConcurrency < 1 {
+			l.autoConcurrency = 1
+		}
+	case statusCode == 0:
+		// Don't speed up on failures, they may be timeouts.
+	default:
+		delay := (l.autoDelay + time.Duration(float64(latency)/a.target())) / 2
+		// Errors come fast and mustn't speed us up.
+		if statusCode < http.StatusBadRequest || delay > l.autoDelay {
+			l.autoDelay = a.clamp(delay)
+		}
+		if statusCode < http.StatusBadRequest && l.autoConcurrency < a.maxConcurrency() {
+			l.autoConcurrency++
+			l.cond.Broadcast()
+		}
+	}
+}